@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	gaugeDerivedPower = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "powermeter",
+		Name:      "derived_power_watts",
+		Help:      "Average power derived from the change of an energy register between readings",
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+			//obis id of the energy register the power is derived from
+			"meter_id",
+		})
+)
+
+// energyBaseline is the reference point for deriving power from an energy register.
+type energyBaseline struct {
+	// value in Wh and time of the last change of the register
+	value float64
+	time  time.Time
+	// time of the most recent reading, to detect gaps
+	lastSeen time.Time
+	// aligned is true once the baseline has been taken at a change of the register.
+	// Meters with a reduced resolution (e.g. without PIN) only increment in steps
+	// of 1 Wh or more, so the first reading might be taken anywhere within a step.
+	aligned bool
+	// smallest increment seen so far, i.e. the resolution of the register in Wh
+	step float64
+	// power derived at the last change of the register
+	power float64
+}
+
+var (
+	energyBaselines     = make(map[string]*energyBaseline)
+	energyBaselinesLock sync.Mutex
+)
+
+// derivePower returns the average power in W since the last change of the
+// energy register, based on the time the readings were taken. It returns false if no power can be derived (yet).
+// While the register does not change, the power is at most one step of the register
+// within the time since its last change, so the returned power decays towards 0
+// instead of dropping to 0 between two steps of a low-resolution register.
+func derivePower(reading meterReading) (float64, bool) {
+	now := reading.time
+	value := reading.scaledValue()
+	energyBaselinesLock.Lock()
+	defer energyBaselinesLock.Unlock()
+	baseline, ok := energyBaselines[reading.name]
+	if !ok {
+		energyBaselines[reading.name] = &energyBaseline{value: value, time: now, lastSeen: now}
+		return 0, false
+	}
+
+	gap := now.Sub(baseline.lastSeen)
+	baseline.lastSeen = now
+	if gap > time.Duration(options.DerivedPowerMaxGap)*time.Second {
+		log.Infof("Gap of %s since last reading of %s, restarting power derivation", gap, reading.name)
+		*baseline = energyBaseline{value: value, time: now, lastSeen: now}
+		return 0, false
+	}
+	if value < baseline.value {
+		log.Infof("Energy register %s decreased from %f to %f, restarting power derivation", reading.name, baseline.value, value)
+		*baseline = energyBaseline{value: value, time: now, lastSeen: now}
+		return 0, false
+	}
+
+	elapsed := now.Sub(baseline.time)
+	if value == baseline.value {
+		if !baseline.aligned || baseline.step == 0 || elapsed <= 0 {
+			return 0, false
+		}
+		if options.DerivedPowerIdle > 0 && elapsed > time.Duration(options.DerivedPowerIdle)*time.Second {
+			return 0, true
+		}
+		if bound := baseline.step / elapsed.Hours(); bound < baseline.power {
+			return bound, true
+		}
+		return 0, false
+	}
+
+	delta := value - baseline.value
+	step := baseline.step
+	if step == 0 || delta < step {
+		step = delta
+	}
+	wasAligned := baseline.aligned
+	*baseline = energyBaseline{value: value, time: now, lastSeen: now, aligned: true, step: step}
+	if !wasAligned || elapsed <= 0 {
+		return 0, false
+	}
+	power := delta / elapsed.Hours()
+	baseline.power = power
+	logDebug("Derived power %f W for %s from %f Wh in %s", power, reading.name, delta, elapsed)
+	return power, true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDerivePower(t *testing.T) {
+	options.DerivedPowerMaxGap = 600
+	options.DerivedPowerIdle = 300
+	energyBaselines = make(map[string]*energyBaseline)
+
+	start := time.Unix(1700000000, 0)
+	reading := func(wh int64, at time.Time) meterReading {
+		return meterReading{name: "1.8.0", unit: SML_UNIT_WATT_HOUR, raw: wh, time: at}
+	}
+
+	if _, ok := derivePower(reading(1000, start)); ok {
+		t.Error("derivePower returned a value for the first reading")
+	}
+	// first change only aligns the baseline to a step of the register
+	if _, ok := derivePower(reading(1001, start.Add(30*time.Second))); ok {
+		t.Error("derivePower returned a value before the baseline was aligned")
+	}
+	if _, ok := derivePower(reading(1001, start.Add(60*time.Second))); ok {
+		t.Error("derivePower returned a value for an unchanged register")
+	}
+	power, ok := derivePower(reading(1011, start.Add(90*time.Second)))
+	if !ok || power != 600 {
+		t.Errorf("derivePower returned %f, %t instead of 600 W", power, ok)
+	}
+	power, ok = derivePower(reading(1011, start.Add(500*time.Second)))
+	if !ok || power != 0 {
+		t.Errorf("derivePower returned %f, %t instead of 0 W for an idle register", power, ok)
+	}
+	if _, ok := derivePower(reading(5, start.Add(530*time.Second))); ok {
+		t.Error("derivePower returned a value after a counter reset")
+	}
+}
+
+func TestDerivePowerLowResolution(t *testing.T) {
+	options.DerivedPowerMaxGap = 600
+	options.DerivedPowerIdle = 0
+	energyBaselines = make(map[string]*energyBaseline)
+
+	// a 10 W load on a register counting in steps of 1 Wh, read every minute
+	start := time.Unix(1700000000, 0)
+	reading := func(wh int64, seconds int) meterReading {
+		return meterReading{name: "1.8.0", unit: SML_UNIT_WATT_HOUR, raw: wh, time: start.Add(time.Duration(seconds) * time.Second)}
+	}
+	derivePower(reading(1000, 0))
+	derivePower(reading(1001, 60))
+	power, ok := derivePower(reading(1002, 420))
+	if !ok || power != 10 {
+		t.Fatalf("derivePower returned %f, %t instead of 10 W", power, ok)
+	}
+	// until the next step is due, the power is kept
+	for seconds := 480; seconds <= 780; seconds += 60 {
+		if power, ok := derivePower(reading(1002, seconds)); ok {
+			t.Errorf("derivePower returned %f W after %d s although the next step is not due yet", power, seconds-420)
+		}
+	}
+	// then it decays, as the power cannot have been more than 1 Wh since the last step
+	power, ok = derivePower(reading(1002, 1020))
+	if !ok || power != 6 {
+		t.Errorf("derivePower returned %f, %t instead of 6 W for an overdue step", power, ok)
+	}
+	power, ok = derivePower(reading(1003, 1140))
+	if !ok || power != 5 {
+		t.Errorf("derivePower returned %f, %t instead of 5 W after the next step", power, ok)
+	}
+}
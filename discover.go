@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+type discoverCommand struct {
+	Timeout int64    `long:"timeout" default:"5" description:"Seconds to listen on each port for every tried setting"`
+	Devices []string `long:"scan" description:"Only scan the given device instead of all detected serial ports (can be repeated)"`
+}
+
+var discoverOptions discoverCommand
+
+// serialPortInfo describes a detected serial device.
+type serialPortInfo struct {
+	path        string
+	device      string
+	vendorID    string
+	productID   string
+	description string
+}
+
+// discoverySetting is a combination of serial settings and protocol we try on each port.
+type discoverySetting struct {
+	protocol string
+	baudRate uint
+	dataBits uint
+	parity   serial.ParityMode
+	request  []byte
+}
+
+func (s discoverySetting) String() string {
+	parity := "N"
+	if s.parity == serial.PARITY_EVEN {
+		parity = "E"
+	}
+	return fmt.Sprintf("%s @ %d %d%s1", s.protocol, s.baudRate, s.dataBits, parity)
+}
+
+var discoverySettings = []discoverySetting{
+	// SML meters push their telegrams unsolicited with 9600 8N1
+	{protocol: "sml", baudRate: 9600, dataBits: 8, parity: serial.PARITY_NONE},
+	// DSMR 4/5 P1 ports push with 115200 8N1, DSMR 2.2 with 9600 7E1
+	{protocol: "dsmr", baudRate: 115200, dataBits: 8, parity: serial.PARITY_NONE},
+	{protocol: "dsmr", baudRate: 9600, dataBits: 7, parity: serial.PARITY_EVEN},
+	// IEC 62056-21 meters answer to a sign-on request at 300 7E1
+	{protocol: "iec", baudRate: 300, dataBits: 7, parity: serial.PARITY_EVEN, request: []byte("/?!\r\n")},
+}
+
+// discoveryResult is the outcome of a successful probe of a port.
+type discoveryResult struct {
+	port     serialPortInfo
+	setting  discoverySetting
+	identity meterIdentity
+}
+
+func (c *discoverCommand) Execute(args []string) error {
+	var ports []serialPortInfo
+	if len(c.Devices) > 0 {
+		for _, device := range c.Devices {
+			ports = append(ports, describeSerialPort(device))
+		}
+	} else {
+		ports = listSerialPorts()
+	}
+	if len(ports) == 0 {
+		return errors.New("No serial ports found")
+	}
+
+	results := make([]discoveryResult, 0, len(ports))
+	for _, port := range ports {
+		fmt.Printf("%s\n", port)
+		found := false
+		for _, setting := range discoverySettings {
+			identity, err := probePort(port.device, setting, time.Duration(c.Timeout)*time.Second)
+			if err != nil {
+				logDebug("Probing %s with %s failed: %v", port.device, setting, err)
+				continue
+			}
+			fmt.Printf("  %s: server ID %q, manufacturer %q\n", setting, identity.serverID, identity.manufacturer)
+			results = append(results, discoveryResult{port: port, setting: setting, identity: identity})
+			found = true
+			break
+		}
+		if !found {
+			fmt.Printf("  no meter data detected\n")
+		}
+	}
+
+	printSuggestedConfig(results)
+	return nil
+}
+
+func (p serialPortInfo) String() string {
+	var sb strings.Builder
+	sb.WriteString(p.path)
+	if p.device != p.path {
+		sb.WriteString(" -> " + p.device)
+	}
+	if len(p.vendorID) > 0 {
+		sb.WriteString(fmt.Sprintf(" [%s:%s]", p.vendorID, p.productID))
+	}
+	if len(p.description) > 0 {
+		sb.WriteString(" " + p.description)
+	}
+	return sb.String()
+}
+
+func printSuggestedConfig(results []discoveryResult) {
+	if len(results) == 0 {
+		return
+	}
+	fmt.Printf("\nSuggested configuration:\n")
+	for _, result := range results {
+		if result.setting.protocol != "sml" {
+			fmt.Printf("  # %s speaks %s, which is not supported by this exporter\n", result.port.path, result.setting.protocol)
+			continue
+		}
+		meterName := result.identity.serverID
+		if len(meterName) == 0 {
+			meterName = filepath.Base(result.port.device)
+		}
+		fmt.Printf("  powermeter_exporter --device=%s --metername=%s\n", result.port.path, meterName)
+	}
+}
+
+// listSerialPorts returns all serial devices which are likely to be an IR reading head.
+// Devices with a stable name in /dev/serial/by-id are preferred over the kernel names.
+func listSerialPorts() []serialPortInfo {
+	seen := make(map[string]bool)
+	ports := make([]serialPortInfo, 0)
+
+	byID, _ := filepath.Glob("/dev/serial/by-id/*")
+	sort.Strings(byID)
+	for _, path := range byID {
+		port := describeSerialPort(path)
+		seen[port.device] = true
+		ports = append(ports, port)
+	}
+
+	for _, pattern := range []string{"/dev/ttyUSB*", "/dev/ttyACM*", "/dev/ttyAMA*", "/dev/irmeter*"} {
+		matches, _ := filepath.Glob(pattern)
+		sort.Strings(matches)
+		for _, path := range matches {
+			port := describeSerialPort(path)
+			if seen[port.device] {
+				continue
+			}
+			seen[port.device] = true
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+func describeSerialPort(path string) serialPortInfo {
+	port := serialPortInfo{path: path, device: path}
+	if device, err := filepath.EvalSymlinks(path); err == nil {
+		port.device = device
+	}
+
+	// walk up the sysfs device tree until we find the USB device carrying the ids
+	sysfsPath, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", filepath.Base(port.device), "device"))
+	if err != nil {
+		return port
+	}
+	for i := 0; i < 5 && sysfsPath != "/"; i++ {
+		if vendorID := readSysfsAttribute(sysfsPath, "idVendor"); len(vendorID) > 0 {
+			port.vendorID = vendorID
+			port.productID = readSysfsAttribute(sysfsPath, "idProduct")
+			port.description = strings.TrimSpace(readSysfsAttribute(sysfsPath, "manufacturer") + " " + readSysfsAttribute(sysfsPath, "product"))
+			break
+		}
+		sysfsPath = filepath.Dir(sysfsPath)
+	}
+	return port
+}
+
+func readSysfsAttribute(dir string, name string) string {
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// probePort listens on the device with the given settings until a telegram
+// of the expected protocol has been seen or the timeout expired.
+func probePort(device string, setting discoverySetting, timeout time.Duration) (meterIdentity, error) {
+	port, err := serial.Open(serial.OpenOptions{
+		PortName:              device,
+		BaudRate:              setting.baudRate,
+		DataBits:              setting.dataBits,
+		StopBits:              1,
+		ParityMode:            setting.parity,
+		InterCharacterTimeout: 500,
+		MinimumReadSize:       0,
+	})
+	if err != nil {
+		return meterIdentity{}, err
+	}
+	defer port.Close()
+
+	if setting.request != nil {
+		if _, err := port.Write(setting.request); err != nil {
+			return meterIdentity{}, err
+		}
+	}
+
+	buffer := make([]byte, 256)
+	data := make([]byte, 0, 2048)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		c, err := port.Read(buffer)
+		if err != nil && err != io.EOF {
+			return meterIdentity{}, err
+		}
+		data = append(data, buffer[:c]...)
+		if identity, ok := detectProtocol(setting.protocol, data); ok {
+			return identity, nil
+		}
+	}
+	logDebug("Received %d bytes on %s without detecting %s", len(data), device, setting.protocol)
+	return meterIdentity{}, errors.New("No telegram detected")
+}
+
+// detectProtocol checks whether data contains a complete telegram of the given protocol.
+func detectProtocol(protocol string, data []byte) (meterIdentity, bool) {
+	switch protocol {
+	case "sml":
+		return detectSml(data)
+	case "dsmr":
+		return detectDsmr(data)
+	case "iec":
+		return detectIec(data)
+	}
+	return meterIdentity{}, false
+}
+
+func detectSml(data []byte) (meterIdentity, bool) {
+	startSequence := mustDecodeStringToHex(SML_ESCAPE + SML_FILE_START)
+	stopSequence := mustDecodeStringToHex(SML_ESCAPE + SML_FILE_END)
+	startIndex := bytes.Index(data, startSequence)
+	if startIndex < 0 {
+		return meterIdentity{}, false
+	}
+	stopIndex := bytes.Index(data[startIndex:], stopSequence)
+	if stopIndex < 0 {
+		return meterIdentity{}, false
+	}
+
+	smlListResponse, err := extractListResponse(data[startIndex : startIndex+stopIndex+len(stopSequence)])
+	if err != nil {
+		// a valid SML file, but without readings we could make use of
+		return meterIdentity{}, true
+	}
+	response, err := parseListResponse(smlListResponse)
+	if err != nil {
+		return meterIdentity{}, true
+	}
+	return extractMeterIdentity(response), true
+}
+
+// detectDsmr looks for a full DSMR P1 telegram, starting with "/XXX5..." and ending with "!CRC".
+func detectDsmr(data []byte) (meterIdentity, bool) {
+	identity, telegram, ok := parseIdentificationLine(data)
+	if !ok {
+		return identity, false
+	}
+	end := bytes.Index(telegram, []byte("\r\n!"))
+	if end < 0 {
+		return identity, false
+	}
+	// the equipment identifier is hex encoded ASCII
+	if value, ok := findObisValue(telegram[:end], "0-0:96.1.1"); ok {
+		if decoded, err := hex.DecodeString(value); err == nil {
+			value = string(decoded)
+		}
+		identity.serverID = value
+	}
+	return identity, true
+}
+
+// detectIec looks for the identification message "/XXXZ<ident>" a meter sends in reply to a sign-on request.
+func detectIec(data []byte) (meterIdentity, bool) {
+	identity, _, ok := parseIdentificationLine(data)
+	return identity, ok
+}
+
+// parseIdentificationLine returns the first identification line "/XXXZ<ident>" in data
+// and the data following it. Shorter lines starting with "/", like the sign-on request
+// echoed by many IR heads, are skipped.
+func parseIdentificationLine(data []byte) (meterIdentity, []byte, bool) {
+	for offset := 0; offset < len(data); {
+		start := bytes.IndexByte(data[offset:], '/')
+		if start < 0 {
+			break
+		}
+		start += offset
+		end := bytes.Index(data[start:], []byte("\r\n"))
+		if end < 0 {
+			break
+		}
+		// identification is at least "/XXXZ" plus one character of the identifier
+		if end >= 6 {
+			line := data[start : start+end]
+			return meterIdentity{manufacturer: string(line[1:4]), serverID: string(line[5:])}, data[start+end:], true
+		}
+		offset = start + 1
+	}
+	return meterIdentity{}, nil, false
+}
+
+func findObisValue(telegram []byte, obis string) (string, bool) {
+	for _, line := range strings.Split(string(telegram), "\r\n") {
+		if strings.HasPrefix(line, obis+"(") && strings.HasSuffix(line, ")") {
+			return line[len(obis)+1 : len(line)-1], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+// dsmrTelegram is the start of a DSMR 5 P1 telegram of a Landis+Gyr E350
+const dsmrTelegram = "/XMX5LGBBFG1012463366\r\n\r\n" +
+	"1-3:0.2.8(50)\r\n" +
+	"0-0:1.0.0(171105201324W)\r\n" +
+	"0-0:96.1.1(4530303331303033303031363939353135)\r\n" +
+	"1-0:1.8.1(002074.842*kWh)\r\n" +
+	"!4A6E\r\n"
+
+func TestDetectProtocol(t *testing.T) {
+	sml := readTestdata("testdata/smlfile-1", t)
+
+	tests := []struct {
+		name         string
+		protocol     string
+		data         []byte
+		detected     bool
+		manufacturer string
+		serverID     string
+	}{
+		{"sml telegram", "sml", sml, true, "ISK", "090149534b00050cd2eb"},
+		{"sml telegram after noise", "sml", append([]byte{0x00, 0x42, 0x1b}, sml...), true, "ISK", "090149534b00050cd2eb"},
+		{"truncated sml telegram", "sml", sml[:len(sml)/2], false, "", ""},
+		{"sml without readings", "sml", mustDecodeStringToHex(SML_ESCAPE + SML_FILE_START + SML_ESCAPE + SML_FILE_END + "000000"), true, "", ""},
+		{"dsmr telegram", "dsmr", []byte(dsmrTelegram), true, "XMX", "E0031003001699515"},
+		{"dsmr header only", "dsmr", []byte("/XMX5LGBBFG1012463366\r\n\r\n1-3:0.2.8(50)\r\n"), false, "XMX", "LGBBFG1012463366"},
+		{"dsmr read as sml", "sml", []byte(dsmrTelegram), false, "", ""},
+		{"sml read as dsmr", "dsmr", sml, false, "", ""},
+		{"iec identification", "iec", []byte("/?!\r\n/ISk5MT174-0001\r\n"), true, "ISk", "MT174-0001"},
+		{"unknown protocol", "mbus", sml, false, "", ""},
+	}
+	for _, test := range tests {
+		identity, detected := detectProtocol(test.protocol, test.data)
+		if detected != test.detected {
+			t.Errorf("%s: detected %t instead of %t", test.name, detected, test.detected)
+		}
+		if identity.manufacturer != test.manufacturer || identity.serverID != test.serverID {
+			t.Errorf("%s: got manufacturer %q and server ID %q instead of %q and %q", test.name, identity.manufacturer, identity.serverID, test.manufacturer, test.serverID)
+		}
+	}
+}
+
+func TestParseIdentificationLine(t *testing.T) {
+	tests := []struct {
+		line         string
+		ok           bool
+		manufacturer string
+		serverID     string
+		rest         string
+	}{
+		{"/XMX5LGBBFG1012463366\r\n1-3:0.2.8(50)", true, "XMX", "LGBBFG1012463366", "\r\n1-3:0.2.8(50)"},
+		{"garbage/ISK5MT691\r\n", true, "ISK", "MT691", "\r\n"},
+		{"/ISK5\r\n", false, "", "", ""},
+		{"/ISK5MT691", false, "", "", ""},
+		{"no identification\r\n", false, "", "", ""},
+	}
+	for _, test := range tests {
+		identity, rest, ok := parseIdentificationLine([]byte(test.line))
+		if ok != test.ok || identity.manufacturer != test.manufacturer || identity.serverID != test.serverID || string(rest) != test.rest {
+			t.Errorf("parseIdentificationLine(%q) returned %q, %q, %q, %t", test.line, identity.manufacturer, identity.serverID, rest, ok)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var energyDesc = prometheus.NewDesc(
+	prometheus.BuildFQName("powermeter", "energy", "watt_hours_total"),
+	"Cumulative active energy registers of the meter",
+	[]string{
+		//manual name of the meter, to distinguish between multiple sensors
+		"meter_name",
+		//obis id of the register, the full code for other channels than 1-0
+		"meter_id",
+		//import (OBIS 1.8.x) or export (OBIS 2.8.x)
+		"direction",
+		//tariff of the register, total for the sum of all tariffs
+		"tariff",
+	}, nil)
+
+// energyKey identifies a single energy register
+type energyKey struct {
+	meterName string
+	obis      obisCode
+}
+
+// energyValue is the last value of an energy register
+type energyValue struct {
+	name      string
+	direction string
+	tariff    string
+	value     float64
+	updated   time.Time
+}
+
+// energyCollector exports the cumulative energy registers as counters. The meter
+// keeps the state, so we only remember the last value of each register.
+type energyCollector struct {
+	mutex  sync.Mutex
+	values map[energyKey]energyValue
+}
+
+func newEnergyCollector() *energyCollector {
+	return &energyCollector{values: make(map[energyKey]energyValue)}
+}
+
+var energyCounters = newEnergyCollector()
+
+func init() {
+	prometheus.MustRegister(energyCounters)
+}
+
+// energyRegister returns direction and tariff of an active energy register,
+// or false if the code is not one.
+func energyRegister(code obisCode) (string, string, bool) {
+	if code.a != 1 || code.d != 8 {
+		return "", "", false
+	}
+	var direction string
+	switch code.c {
+	case 1:
+		direction = "import"
+	case 2:
+		direction = "export"
+	default:
+		return "", "", false
+	}
+	if lookupObis(code).Type == "gauge" {
+		// overridden by the mapping
+		return "", "", false
+	}
+	tariff := "total"
+	if code.e != 0 {
+		tariff = strconv.Itoa(int(code.e))
+	}
+	return direction, tariff, true
+}
+
+// record stores the reading if it is an energy register
+func (c *energyCollector) record(meterName string, reading meterReading) {
+	direction, tariff, ok := energyRegister(reading.obis)
+	if !ok || reading.unit != SML_UNIT_WATT_HOUR {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[energyKey{meterName: meterName, obis: reading.obis}] = energyValue{name: reading.name, direction: direction, tariff: tariff, value: reading.scaledValue(), updated: time.Now()}
+}
+
+// expire removes the registers which have not been recorded within maxAge
+func (c *energyCollector) expire(maxAge time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, register := range c.values {
+		if time.Since(register.updated) > maxAge {
+			log.Infof("Expiring energy register %s of %s, last updated at %s", register.name, key.meterName, register.updated)
+			delete(c.values, key)
+		}
+	}
+}
+
+func (c *energyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- energyDesc
+}
+
+func (c *energyCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, register := range c.values {
+		ch <- prometheus.MustNewConstMetric(energyDesc, prometheus.CounterValue, register.value, key.meterName, register.name, register.direction, register.tariff)
+	}
+}
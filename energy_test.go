@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEnergyCollector(t *testing.T) {
+	collector := newEnergyCollector()
+	collector.record("test", meterReading{name: "1.8.0", obis: mustParseObisCode("1.8.0"), unit: SML_UNIT_WATT_HOUR, raw: 13775, scaler: -1})
+	collector.record("test", meterReading{name: "2.8.1", obis: mustParseObisCode("2.8.1"), unit: SML_UNIT_WATT_HOUR, raw: 42})
+	// a second import register on channel 1, e.g. of a heat pump
+	heatPump := mustParseObisCode("1-1:1.8.0*255")
+	obisRegistry[heatPump] = obisInfo{Name: "Heat pump import", Unit: "Wh", Type: "counter"}
+	defer delete(obisRegistry, heatPump)
+	collector.record("test", meterReading{name: heatPump.shortName(), obis: heatPump, unit: SML_UNIT_WATT_HOUR, raw: 500})
+	collector.record("test", meterReading{name: "16.7.0", obis: mustParseObisCode("16.7.0"), unit: SML_UNIT_WATT, raw: 500})
+
+	expected := `
+# HELP powermeter_energy_watt_hours_total Cumulative active energy registers of the meter
+# TYPE powermeter_energy_watt_hours_total counter
+powermeter_energy_watt_hours_total{direction="export",meter_id="2.8.1",meter_name="test",tariff="1"} 42
+powermeter_energy_watt_hours_total{direction="import",meter_id="1-1:1.8.0*255",meter_name="test",tariff="total"} 500
+powermeter_energy_watt_hours_total{direction="import",meter_id="1.8.0",meter_name="test",tariff="total"} 1377.5
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnergyCollectorExpire(t *testing.T) {
+	collector := newEnergyCollector()
+	collector.record("test", meterReading{name: "1.8.0", obis: mustParseObisCode("1.8.0"), unit: SML_UNIT_WATT_HOUR, raw: 13775})
+	collector.expire(time.Minute)
+	if count := testutil.CollectAndCount(collector); count != 1 {
+		t.Errorf("collector expired a fresh register, %d left", count)
+	}
+	collector.values[energyKey{meterName: "test", obis: mustParseObisCode("1.8.0")}] = energyValue{name: "1.8.0", updated: time.Now().Add(-2 * time.Minute)}
+	collector.expire(time.Minute)
+	if count := testutil.CollectAndCount(collector); count != 0 {
+		t.Errorf("collector kept %d outdated registers", count)
+	}
+}
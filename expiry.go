@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// seriesExpiry tracks when series of gauges have been set last, to remove
+// series which have not been refreshed for a while.
+type seriesExpiry struct {
+	mutex   sync.Mutex
+	updated map[*prometheus.GaugeVec]map[string]time.Time
+}
+
+var gaugeExpiry = &seriesExpiry{updated: make(map[*prometheus.GaugeVec]map[string]time.Time)}
+
+// labelSeparator joins label values to a key, it can't be part of valid UTF-8
+const labelSeparator = "\xff"
+
+// touch marks the series as refreshed. Series of a nil seriesExpiry never expire.
+func (e *seriesExpiry) touch(gauge *prometheus.GaugeVec, labelValues ...string) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if _, ok := e.updated[gauge]; !ok {
+		e.updated[gauge] = make(map[string]time.Time)
+	}
+	e.updated[gauge][strings.Join(labelValues, labelSeparator)] = time.Now()
+}
+
+// expire deletes all tracked series which have not been touched within maxAge
+func (e *seriesExpiry) expire(maxAge time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for gauge, series := range e.updated {
+		for key, updated := range series {
+			if time.Since(updated) > maxAge {
+				labelValues := strings.Split(key, labelSeparator)
+				log.Infof("Expiring series %v, last updated at %s", labelValues, updated)
+				gauge.DeleteLabelValues(labelValues...)
+				delete(series, key)
+			}
+		}
+	}
+}
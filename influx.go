@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// influxWriter writes readings as line protocol points to InfluxDB, either
+// to the v1 /write API (database and retention policy) or to the v2
+// /api/v2/write API (organization and bucket).
+type influxWriter struct {
+	writeURL  string
+	username  string
+	password  string
+	token     string
+	batchSize int
+	client    *http.Client
+	queue     *spoolQueue
+}
+
+var influxOutput *influxWriter
+
+// influxEscaper escapes tag keys and values as required by the line protocol
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func newInfluxWriter() (*influxWriter, error) {
+	base, err := url.Parse(options.InfluxURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid InfluxDB URL: %v", err)
+	}
+	query := url.Values{}
+	query.Set("precision", "ms")
+	if len(options.InfluxBucket) > 0 {
+		if len(options.InfluxOrg) == 0 {
+			return nil, errors.New("InfluxDB v2 needs --influxOrg in addition to --influxBucket")
+		}
+		base = base.JoinPath("api", "v2", "write")
+		query.Set("org", options.InfluxOrg)
+		query.Set("bucket", options.InfluxBucket)
+	} else {
+		if len(options.InfluxDatabase) == 0 {
+			return nil, errors.New("InfluxDB needs either --influxDatabase (v1) or --influxBucket (v2)")
+		}
+		base = base.JoinPath("write")
+		query.Set("db", options.InfluxDatabase)
+		if len(options.InfluxRetentionPolicy) > 0 {
+			query.Set("rp", options.InfluxRetentionPolicy)
+		}
+	}
+	base.RawQuery = query.Encode()
+	if options.InfluxBatchSize < 1 {
+		return nil, fmt.Errorf("Invalid --influxBatchSize %d, it must be at least 1", options.InfluxBatchSize)
+	}
+
+	queue, err := newSpoolQueue("influxdb", options.InfluxQueueDir, options.InfluxQueueSize)
+	if err != nil {
+		return nil, err
+	}
+	return &influxWriter{
+		writeURL:  base.String(),
+		username:  options.InfluxUser,
+		password:  options.InfluxPassword,
+		token:     options.InfluxToken,
+		batchSize: options.InfluxBatchSize,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		queue:     queue,
+	}, nil
+}
+
+// formatInfluxPoint formats a reading as line protocol point with millisecond precision
+func formatInfluxPoint(meterName string, reading meterReading) []byte {
+	var sb strings.Builder
+	sb.WriteString("powermeter")
+	if len(meterName) > 0 {
+		sb.WriteString(",meter_name=" + influxEscaper.Replace(meterName))
+	}
+	sb.WriteString(",obis=" + influxEscaper.Replace(reading.name))
+	if unit, ok := unitSymbols[reading.unit]; ok {
+		sb.WriteString(",unit=" + influxEscaper.Replace(unit))
+	}
+	sb.WriteString(" value=" + strconv.FormatFloat(reading.value, 'f', -1, 64))
+	sb.WriteString(" " + strconv.FormatInt(reading.time.UnixMilli(), 10))
+	return []byte(sb.String())
+}
+
+// write queues a reading to be sent with the next batch
+func (w *influxWriter) write(meterName string, reading meterReading) {
+	w.queue.push(formatInfluxPoint(meterName, reading))
+}
+
+// run sends the queued points every interval until the process ends
+func (w *influxWriter) run(interval time.Duration) {
+	flushPeriodically(w.queue, interval, w.flush)
+}
+
+// flush sends the oldest batch of queued points. Points are kept for a retry
+// if InfluxDB is unreachable, see classifyWriteResponse for its answers.
+func (w *influxWriter) flush() error {
+	batch, last := w.queue.peek(w.batchSize)
+	if len(batch) == 0 {
+		return nil
+	}
+	request, err := http.NewRequest(http.MethodPost, w.writeURL, bytes.NewReader(bytes.Join(batch, []byte("\n"))))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	request.Header.Set("User-Agent", "powermeter_exporter")
+	if len(w.token) > 0 {
+		request.Header.Set("Authorization", "Token "+w.token)
+	} else if len(w.username) > 0 {
+		request.SetBasicAuth(w.username, w.password)
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+
+	drop, err := classifyWriteResponse(response, body)
+	switch {
+	case err != nil:
+		return err
+	case drop:
+		log.Warnf("InfluxDB rejected %d points with %s: %s", len(batch), response.Status, bytes.TrimSpace(body))
+		w.queue.drop(last)
+	default:
+		logDebug("Writing %d points to InfluxDB succeeded", len(batch))
+		w.queue.remove(last)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFormatInfluxPoint(t *testing.T) {
+	reading := meterReading{name: "1.8.0", value: 1234.5, unit: SML_UNIT_WATT_HOUR, time: time.UnixMilli(1700000000123)}
+	expected := `powermeter,meter_name=main\ meter,obis=1.8.0,unit=Wh value=1234.5 1700000000123`
+	if point := string(formatInfluxPoint("main meter", reading)); point != expected {
+		t.Errorf("Point is %q instead of %q", point, expected)
+	}
+}
+
+func TestInfluxWriter(t *testing.T) {
+	defer func(saved string, savedOrg string, savedBucket string, savedToken string) {
+		options.InfluxURL, options.InfluxOrg, options.InfluxBucket, options.InfluxToken = saved, savedOrg, savedBucket, savedToken
+	}(options.InfluxURL, options.InfluxOrg, options.InfluxBucket, options.InfluxToken)
+
+	var requestURI, authorization, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, _ := io.ReadAll(r.Body)
+		requestURI, authorization, body = r.URL.RequestURI(), r.Header.Get("Authorization"), string(content)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	options.InfluxURL = server.URL
+	options.InfluxOrg = "home"
+	options.InfluxBucket = "energy"
+	options.InfluxToken = "secret"
+	options.InfluxBatchSize = 10
+	options.InfluxQueueSize = 10
+	writer, err := newInfluxWriter()
+	if err != nil {
+		t.Fatalf("newInfluxWriter failed: %v", err)
+	}
+	writer.write("test", meterReading{name: "1.8.0", value: 1, time: time.UnixMilli(1000)})
+	writer.write("test", meterReading{name: "2.8.0", value: 2, time: time.UnixMilli(1000)})
+	if err := writer.flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	if expected := "/api/v2/write?bucket=energy&org=home&precision=ms"; requestURI != expected {
+		t.Errorf("Request URI is %q instead of %q", requestURI, expected)
+	}
+	if authorization != "Token secret" {
+		t.Errorf("Authorization header is %q", authorization)
+	}
+	if expected := "powermeter,meter_name=test,obis=1.8.0 value=1 1000\npowermeter,meter_name=test,obis=2.8.0 value=2 1000"; body != expected {
+		t.Errorf("Body is %q instead of %q", body, expected)
+	}
+	if writer.queue.len() != 0 {
+		t.Errorf("Queue still holds %d points after a successful flush", writer.queue.len())
+	}
+}
+
+func TestInfluxWriterV1(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	var requestURI string
+	var username, password string
+	var authorized bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURI = r.URL.RequestURI()
+		username, password, authorized = r.BasicAuth()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	options.InfluxURL = server.URL
+	options.InfluxDatabase = "energy"
+	options.InfluxRetentionPolicy = "one year"
+	options.InfluxUser = "writer"
+	options.InfluxPassword = "secret"
+	options.InfluxBatchSize = 10
+	options.InfluxQueueSize = 10
+	writer, err := newInfluxWriter()
+	if err != nil {
+		t.Fatalf("newInfluxWriter failed: %v", err)
+	}
+	writer.write("test", meterReading{name: "1.8.0", value: 1, time: time.UnixMilli(1000)})
+	if err := writer.flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	if expected := "/write?db=energy&precision=ms&rp=one+year"; requestURI != expected {
+		t.Errorf("Request URI is %q instead of %q", requestURI, expected)
+	}
+	if !authorized || username != "writer" || password != "secret" {
+		t.Errorf("Basic auth is %q/%q (%t)", username, password, authorized)
+	}
+}
+
+func TestInfluxWriterBatchSize(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.InfluxURL = "http://localhost:8086"
+	options.InfluxDatabase = "energy"
+	for _, batchSize := range []int{0, -1} {
+		options.InfluxBatchSize = batchSize
+		if _, err := newInfluxWriter(); err == nil {
+			t.Errorf("newInfluxWriter accepted a batch size of %d", batchSize)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package main // import "github.com/sfudeus/powermeter_exporter"
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/jacobsa/go-serial/serial"
@@ -18,49 +22,174 @@ import (
 var port io.ReadWriteCloser
 
 var options struct {
-	Port                     int64  `long:"port" default:"8080" description:"The address to listen on for HTTP requests." env:"EXPORTER_PORT"`
-	Interval                 int64  `long:"interval" default:"60" env:"INTERVAL" description:"The frequency in seconds in which to gather data"`
-	Device                   string `long:"device" default:"/dev/irmeter0" description:"The device to read on"`
-	MeterName                string `long:"metername" description:"The name of your meter, to uniquely name them if you have multiple"`
-	Factor                   int64  `long:"factor" description:"Reduction factor for all readings" default:"1"`
-	MaxValue                 int64  `long:"maxValue" description:"Maximum value for readings, to prevent overflows" default:"10000000"`
-	Debug                    bool   `long:"debug" description:"Activate debug mode"`
-	KeepAlive                bool   `long:"keepalive" description:"When true, keep tty connection open between reads"`
-	MqttHost                 string `long:"mqttHost" description:"MQTT host to send data to (optional)"`
-	MqttPort                 int64  `long:"mqttPort" description:"MQTT port to send data to (optional)" default:"1883"`
-	MqttTls                  bool   `long:"mqttTls" description:"Activate TLS for MQTT"`
-	MqttTlsInsecure          bool   `long:"mqttTlsInsecure" description:"Allow insecure TLS for MQTT"`
-	MqttTopicPrefix          string `long:"mqttTopicPrefix" description:"Topic prefix for MQTT" default:"powermeter"`
-	MqttDiscoveryTopicPrefix string `long:"mqttDiscoveryTopicPrefix" description:"Topic prefix for homeassistant discovery" default:"homeassistant"`
-	MqttUser                 string `long:"mqttUser" description:"Username to use for the MQTT connection" env:"MQTT_USER"`
-	MqttPassword             string `long:"mqttPassword" description:"Password to use for the MQTT connection" env:"MQTT_PASSWORD"`
+	Port                     int64             `long:"port" default:"8080" description:"The address to listen on for HTTP requests." env:"EXPORTER_PORT"`
+	Interval                 int64             `long:"interval" default:"60" env:"INTERVAL" description:"The frequency in seconds in which to gather data"`
+	ReadMode                 string            `long:"readMode" default:"interval" choice:"interval" choice:"scrape" choice:"none" description:"Read the meter every --interval, on each scrape of /metrics or not at all to only serve /probe"`
+	ReadTimeout              int64             `long:"readTimeout" default:"30" description:"Seconds to wait for a complete telegram before giving up (0 to wait forever, or 10s in scrape read mode)"`
+	VerifyChecksum           bool              `long:"verifyChecksum" description:"Read and verify the CRC at the end of each SML file"`
+	ExpireAfter              int64             `long:"expireAfter" description:"Remove readings which have not been refreshed for this many intervals (0 to keep them forever)"`
+	CacheTTL                 int64             `long:"cacheTTL" default:"10" description:"Seconds to serve cached readings in scrape read mode"`
+	Device                   string            `long:"device" default:"/dev/irmeter0" description:"The device to read on"`
+	MeterName                string            `long:"metername" description:"The name of your meter, to uniquely name them if you have multiple"`
+	Factor                   int64             `long:"factor" description:"Reduction factor for all readings" default:"1"`
+	MaxValue                 int64             `long:"maxValue" description:"Maximum value for counter readings in their unit, e.g. Wh, to detect garbage" default:"1000000000"`
+	MaxEnergyDeltaPerHour    float64           `long:"maxEnergyDeltaPerHour" description:"Maximum increase of an energy register in Wh per hour" default:"50000"`
+	MinPower                 float64           `long:"minPower" description:"Minimum plausible power reading in W" default:"-50000"`
+	MaxPower                 float64           `long:"maxPower" description:"Maximum plausible power reading in W" default:"50000"`
+	PlausibilityResetAfter   int64             `long:"plausibilityResetAfter" description:"Accept a counter reading after this many consecutive rejections, e.g. after a meter replacement (0 to never)" default:"10"`
+	Debug                    bool              `long:"debug" description:"Activate debug mode"`
+	KeepAlive                bool              `long:"keepalive" description:"When true, keep tty connection open between reads"`
+	MqttHost                 string            `long:"mqttHost" description:"MQTT host to send data to (optional)"`
+	MqttPort                 int64             `long:"mqttPort" description:"MQTT port to send data to (optional)" default:"1883"`
+	MqttTls                  bool              `long:"mqttTls" description:"Activate TLS for MQTT"`
+	MqttTlsInsecure          bool              `long:"mqttTlsInsecure" description:"Allow insecure TLS for MQTT"`
+	MqttTopicPrefix          string            `long:"mqttTopicPrefix" description:"Topic prefix for MQTT" default:"powermeter"`
+	MqttDiscoveryTopicPrefix string            `long:"mqttDiscoveryTopicPrefix" description:"Topic prefix for homeassistant discovery" default:"homeassistant"`
+	MqttQos                  byte              `long:"mqttQos" default:"0" choice:"0" choice:"1" choice:"2" description:"QoS for MQTT state messages"`
+	MqttRetain               bool              `long:"mqttRetain" description:"Retain MQTT state messages, so new subscribers get the last reading immediately"`
+	MqttDiscoveryQos         byte              `long:"mqttDiscoveryQos" default:"0" choice:"0" choice:"1" choice:"2" description:"QoS for homeassistant discovery messages"`
+	MqttDiscoveryRetain      bool              `long:"mqttDiscoveryRetain" description:"Retain homeassistant discovery messages, so entities survive a restart of homeassistant"`
+	MqttClientID             string            `long:"mqttClientId" description:"Client ID for the MQTT connection (default: powermeter_exporter_<hostname>_<metername>)"`
+	MqttVersion              string            `long:"mqttVersion" default:"3.1.1" choice:"3.1.1" choice:"5" description:"MQTT protocol version"`
+	MqttMessageExpiry        int64             `long:"mqttMessageExpiry" description:"Seconds after which the broker discards undelivered readings, MQTT 5 only (0 to never)"`
+	MqttOfflineAfter         int64             `long:"mqttOfflineAfter" default:"3" description:"Mark readings as offline on MQTT after this many consecutive failed reads (0 to never)"`
+	MqttQueueSize            int               `long:"mqttQueueSize" default:"1000" description:"Maximum number of MQTT messages to keep while the broker is unreachable (0 to drop them)"`
+	MqttQueueDir             string            `long:"mqttQueueDir" description:"Directory to keep unsent MQTT messages in across restarts (optional)"`
+	MqttPayload              string            `long:"mqttPayload" default:"plain" choice:"plain" choice:"json" description:"Publish each reading as plain value on its own topic or all readings of a telegram as JSON"`
+	DerivedPower             bool              `long:"derivedPower" description:"Derive average power from consecutive readings of energy registers"`
+	DerivedPowerMaxGap       int64             `long:"derivedPowerMaxGap" default:"600" description:"Maximum seconds between two readings to derive power from them"`
+	DerivedPowerIdle         int64             `long:"derivedPowerIdle" default:"0" description:"Seconds without a change of an energy register after which the derived power is reported as 0 (0 to never)"`
+	SensorTimeMaxDrift       int64             `long:"sensorTimeMaxDrift" default:"60" description:"Maximum seconds the meter's clock may drift from the wall clock before timestamps are re-anchored"`
+	StateFile                string            `long:"stateFile" description:"File to persist the last accepted readings in, to validate readings after a restart (optional)"`
+	StateInterval            int64             `long:"stateInterval" default:"900" description:"Seconds between writes of the state file, which is also written on shutdown"`
+	ProbeConfig              string            `long:"probeConfig" description:"YAML file with modules for the /probe endpoint"`
+	ObisMapping              string            `long:"obisMapping" description:"YAML file with names, units and types of additional OBIS codes"`
+	RemoteWriteURL           string            `long:"remoteWriteUrl" description:"Prometheus remote_write endpoint to push readings to (optional)"`
+	RemoteWriteUser          string            `long:"remoteWriteUser" description:"Username for basic auth at the remote_write endpoint" env:"REMOTE_WRITE_USER"`
+	RemoteWritePassword      string            `long:"remoteWritePassword" description:"Password for basic auth at the remote_write endpoint" env:"REMOTE_WRITE_PASSWORD"`
+	RemoteWriteBearerToken   string            `long:"remoteWriteBearerToken" description:"Bearer token for the remote_write endpoint" env:"REMOTE_WRITE_BEARER_TOKEN"`
+	RemoteWriteInterval      int64             `long:"remoteWriteInterval" default:"15" description:"Seconds between pushes to the remote_write endpoint"`
+	RemoteWriteQueueSize     int               `long:"remoteWriteQueueSize" default:"10000" description:"Maximum number of samples to keep while the remote_write endpoint is unreachable"`
+	RemoteWriteQueueDir      string            `long:"remoteWriteQueueDir" description:"Directory to keep unsent samples in across restarts (optional)"`
+	InfluxURL                string            `long:"influxUrl" description:"Base URL of an InfluxDB to write readings to (optional)"`
+	InfluxDatabase           string            `long:"influxDatabase" description:"Database to write to with the InfluxDB v1 API"`
+	InfluxRetentionPolicy    string            `long:"influxRetentionPolicy" description:"Retention policy to write to with the InfluxDB v1 API (optional)"`
+	InfluxUser               string            `long:"influxUser" description:"Username for the InfluxDB v1 API" env:"INFLUX_USER"`
+	InfluxPassword           string            `long:"influxPassword" description:"Password for the InfluxDB v1 API" env:"INFLUX_PASSWORD"`
+	InfluxOrg                string            `long:"influxOrg" description:"Organization to write to with the InfluxDB v2 API"`
+	InfluxBucket             string            `long:"influxBucket" description:"Bucket to write to with the InfluxDB v2 API"`
+	InfluxToken              string            `long:"influxToken" description:"API token for InfluxDB v2" env:"INFLUX_TOKEN"`
+	InfluxInterval           int64             `long:"influxInterval" default:"15" description:"Seconds between writes to InfluxDB"`
+	InfluxBatchSize          int               `long:"influxBatchSize" default:"500" description:"Maximum number of points per write to InfluxDB"`
+	InfluxQueueSize          int               `long:"influxQueueSize" default:"10000" description:"Maximum number of points to keep while InfluxDB is unreachable"`
+	InfluxQueueDir           string            `long:"influxQueueDir" description:"Directory to keep unsent points in across restarts (optional)"`
+	OtlpEndpoint             string            `long:"otlpEndpoint" description:"OpenTelemetry collector to push metrics to, as host:port or URL (optional, OTEL_EXPORTER_OTLP_ENDPOINT is used if not given)"`
+	OtlpProtocol             string            `long:"otlpProtocol" default:"grpc" choice:"grpc" choice:"http" description:"Protocol to use for OTLP"`
+	OtlpInsecure             bool              `long:"otlpInsecure" description:"Connect to the OpenTelemetry collector without TLS"`
+	OtlpHeaders              map[string]string `long:"otlpHeader" description:"Header to send with OTLP requests as key:value, like authentication (can be repeated)"`
+	OtlpInterval             int64             `long:"otlpInterval" default:"60" description:"Seconds between pushes of metrics via OTLP"`
+	MqttUser                 string            `long:"mqttUser" description:"Username to use for the MQTT connection" env:"MQTT_USER"`
+	MqttPassword             string            `long:"mqttPassword" description:"Password to use for the MQTT connection" env:"MQTT_PASSWORD"`
+	MqttPasswordFile         string            `long:"mqttPasswordFile" description:"File to read the password for the MQTT connection from, e.g. a Docker secret" env:"MQTT_PASSWORD_FILE"`
+	MqttCaFile               string            `long:"mqttCaFile" description:"PEM file with the CA certificates to verify the MQTT broker with, instead of the system ones"`
+	MqttCertFile             string            `long:"mqttCertFile" description:"PEM file with the client certificate for the MQTT connection"`
+	MqttKeyFile              string            `long:"mqttKeyFile" description:"PEM file with the key of the client certificate for the MQTT connection"`
+	MqttServerName           string            `long:"mqttServerName" description:"Name to verify the certificate of the MQTT broker against, if it differs from --mqttHost"`
 }
 
 var (
-	gaugeReading = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	gaugeReading  = newReadingGauge(promauto.With(prometheus.DefaultRegisterer))
+	gaugeLastRead = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "powermeter",
-		Name:      "reading",
-		Help:      "Current meter reading for consumed energy (unit depends on OBIS id)",
+		Name:      "last_read_timestamp_seconds",
+		Help:      "Unix timestamp of the last successfully read telegram",
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+		})
+	counterReadSuccess = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "powermeter",
+		Name:      "read_success_total",
+		Help:      "Number of successfully read telegrams",
 	},
 		[]string{
 			//manual name of the meter, to distinguish between multiple sensors
 			"meter_name",
-			//obis id of the meter, like 1.8.1 for consumed electrical energy, first tariff
-			"meter_id",
 		})
-	gatheringDuration = promauto.NewSummaryVec(prometheus.SummaryOpts{
+	counterReadErrors = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "powermeter",
-		Name:      "gatheringduration",
-		Help:      "The duration of data gatherings",
+		Name:      "read_errors_total",
+		Help:      "Number of failed reads by reason",
 	},
 		[]string{
 			//manual name of the meter, to distinguish between multiple sensors
 			"meter_name",
+			//reason of the failure, one of timeout, framing, crc, no_list_response or no_readings
+			"reason",
 		})
-	connectionSetups = promauto.NewSummaryVec(prometheus.SummaryOpts{
+	gaugeLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "powermeter",
-		Name:      "connection_setup",
-		Help:      "The duration of connection setups",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful read",
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+		})
+	gaugeUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "powermeter",
+		Name:      "up",
+		Help:      "Whether the last read of the meter was successful",
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+		})
+	gatheringDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                      "powermeter",
+		Name:                           "gatheringduration",
+		Help:                           "The duration of data gatherings",
+		Buckets:                        []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8, 16, 32},
+		NativeHistogramBucketFactor:    1.1,
+		NativeHistogramMaxBucketNumber: 100,
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+		})
+	telegramSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                      "powermeter",
+		Name:                           "telegram_size_bytes",
+		Help:                           "The size of read telegrams",
+		Buckets:                        prometheus.ExponentialBuckets(64, 2, 8),
+		NativeHistogramBucketFactor:    1.1,
+		NativeHistogramMaxBucketNumber: 100,
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+		})
+	telegramInterval = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                      "powermeter",
+		Name:                           "telegram_interval_seconds",
+		Help:                           "The time between consecutive accepted telegrams, based on the meter's clock if available",
+		Buckets:                        []float64{0.5, 1, 2, 4, 8, 16, 32, 64, 128, 300},
+		NativeHistogramBucketFactor:    1.1,
+		NativeHistogramMaxBucketNumber: 100,
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+		})
+	meterInfo        = newMeterInfoGauge(promauto.With(prometheus.DefaultRegisterer))
+	connectionSetups = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                      "powermeter",
+		Name:                           "connection_setup",
+		Help:                           "The duration of connection setups",
+		Buckets:                        prometheus.ExponentialBuckets(0.0005, 4, 8),
+		NativeHistogramBucketFactor:    1.1,
+		NativeHistogramMaxBucketNumber: 100,
 	},
 		[]string{
 			//manual name of the meter, to distinguish between multiple sensors
@@ -77,103 +206,421 @@ var (
 		})
 )
 
+func newReadingGauge(factory promauto.Factory) *prometheus.GaugeVec {
+	return factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "powermeter",
+		Name:      "reading",
+		Help:      "Current meter reading for consumed energy (unit depends on OBIS id)",
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+			//obis id of the meter, like 1.8.1 for consumed electrical energy, first tariff
+			"meter_id",
+		})
+}
+
+func newMeterInfoGauge(factory promauto.Factory) *prometheus.GaugeVec {
+	return factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "powermeter",
+		Name:      "meter_info",
+		Help:      "Identity of the meter as reported in its telegrams, always 1",
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+			//server id of the meter, hex encoded
+			"server_id",
+			//manufacturer id of the meter, like ESY or ISK
+			"manufacturer",
+			//firmware version of the meter, if reported
+			"firmware",
+		})
+}
+
 type meterReading struct {
 	name  string
+	obis  obisCode
 	value float64
+	// unit, scaler and raw value as sent by the meter
+	unit   byte
+	scaler int8
+	raw    int64
+	// status word of the reading, if sent by the meter
+	status    uint64
+	hasStatus bool
+	// time the reading was taken, derived from the meter's clock if available
+	time time.Time
 }
 
+// scaledValue returns the reading in its unit, independent of --factor
+func (r meterReading) scaledValue() float64 {
+	if r.scaler < 0 {
+		// dividing avoids rounding errors of negative powers of ten
+		return float64(r.raw) / math.Pow10(-int(r.scaler))
+	}
+	return float64(r.raw) * math.Pow10(int(r.scaler))
+}
+
+// currentIdentity is the identity of the meter as seen in the last telegram
+var currentIdentity meterIdentity
+
 func main() {
-	_, err := flags.Parse(&options)
+	parser := flags.NewParser(&options, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		if options.Debug {
+			log.SetLevel(log.DebugLevel)
+		}
+		if command == nil {
+			return nil
+		}
+		return command.Execute(args)
+	}
+	_, err := parser.AddCommand("discover", "Discover serial ports carrying meter data",
+		"Scans all serial ports for SML, IEC 62056-21 and DSMR telegrams and reports the identity of the meters found.",
+		&discoverOptions)
+	if err != nil {
+		log.Fatalf("Failed to set up commands: %v", err)
+	}
+	_, err = parser.Parse()
 	if err != nil {
 		os.Exit(1)
 	}
+	if parser.Active != nil {
+		// a command has been executed, nothing left to do
+		return
+	}
 
-	if options.Debug {
-		log.SetLevel(log.DebugLevel)
+	if len(options.ObisMapping) > 0 {
+		if err := loadObisMapping(options.ObisMapping); err != nil {
+			log.Fatalf("Failed to load OBIS mapping: %v", err)
+		}
+	}
+
+	if len(options.StateFile) > 0 {
+		if err := loadState(options.StateFile); err != nil {
+			log.Fatalf("Failed to load state: %v", err)
+		}
+		go saveStatePeriodically(options.StateFile, time.Duration(options.StateInterval)*time.Second)
 	}
 
 	if len(options.MqttHost) > 0 {
+		if err := validateMqttOptions(); err != nil {
+			log.Fatalf("Invalid MQTT options: %v", err)
+		}
+		if err := loadMqttCredentials(); err != nil {
+			log.Fatalf("Failed to load MQTT credentials: %v", err)
+		}
+		if options.MqttQueueSize > 0 {
+			if mqttQueue, err = newSpoolQueue("mqtt", options.MqttQueueDir, options.MqttQueueSize); err != nil {
+				log.Fatalf("Failed to set up MQTT queue: %v", err)
+			}
+		}
 		connectMqtt()
 	}
 
+	if otlpEnabled() {
+		// the identity of the meter is added once it is known
+		startOtlpExport(meterIdentity{})
+		go runOtlpRestarts()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		if options.KeepAlive {
-			port = openConnection()
-			defer closeConnection()
-		}
-		iteration := 0
-		for {
-			ok := gatherData(iteration)
-			iteration++
-			if !ok && options.KeepAlive {
-				log.Printf("Data Gathering failed, resetting port")
-				closeConnection()
-				port = openConnection()
-				connectionResets.WithLabelValues(options.MeterName).Inc()
-			}
-			time.Sleep(time.Duration(options.Interval) * time.Second)
-		}
+		received := <-signals
+		log.Infof("Received %s, shutting down", received)
+		go func() {
+			received := <-signals
+			log.Warnf("Received %s again, exiting without waiting for the shutdown", received)
+			os.Exit(1)
+		}()
+		shutdown()
+		os.Exit(0)
 	}()
-	http.Handle("/metrics", promhttp.Handler())
+
+	if len(options.RemoteWriteURL) > 0 {
+		remoteWrite, err = newRemoteWriter(options.RemoteWriteURL, options.RemoteWriteQueueDir, options.RemoteWriteQueueSize)
+		if err != nil {
+			log.Fatalf("Failed to set up remote write: %v", err)
+		}
+		go remoteWrite.run(time.Duration(options.RemoteWriteInterval) * time.Second)
+	}
+
+	if len(options.InfluxURL) > 0 {
+		influxOutput, err = newInfluxWriter()
+		if err != nil {
+			log.Fatalf("Failed to set up InfluxDB output: %v", err)
+		}
+		go influxOutput.run(time.Duration(options.InfluxInterval) * time.Second)
+	}
+
+	if len(options.ProbeConfig) > 0 {
+		if err := loadProbeConfig(options.ProbeConfig); err != nil {
+			log.Fatalf("Failed to load probe configuration: %v", err)
+		}
+	}
+	http.HandleFunc("/probe", probeHandler)
+
+	if options.KeepAlive && options.ReadMode != "none" {
+		port = openConnection()
+	}
+
+	switch options.ReadMode {
+	case "none":
+		log.Info("Not reading a local meter, only serving /probe")
+		http.Handle("/metrics", promhttp.Handler())
+	case "scrape":
+		http.Handle("/metrics", scrapeHandler(promhttp.Handler()))
+	default:
+		go func() {
+			for {
+				gatherAndRecover()
+				time.Sleep(time.Duration(options.Interval) * time.Second)
+			}
+		}()
+		http.Handle("/metrics", promhttp.Handler())
+	}
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", options.Port), nil))
 }
 
+// shutdownTimeout limits the time to send what is still queued on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// shutdown sends what is still queued, saves the state and closes all connections
+func shutdown() {
+	deadline := time.Now().Add(shutdownTimeout)
+	if remoteWrite != nil {
+		flushRemaining(remoteWrite.queue, remoteWrite.flush, deadline)
+	}
+	if influxOutput != nil {
+		flushRemaining(influxOutput.queue, influxOutput.flush, deadline)
+	}
+	if mqttQueue != nil && mqttClient != nil && mqttClient.IsConnected() {
+		drainMqttQueueBefore(deadline)
+	}
+	if len(options.StateFile) > 0 {
+		saveStateIfChanged(options.StateFile)
+	}
+	if options.KeepAlive && options.ReadMode != "none" {
+		closeConnection()
+	}
+	disconnectMqtt()
+	stopOtlpExport()
+}
+
+// gatherAndRecover gathers data once and resets a kept alive port if that failed.
+// It returns whether the read succeeded.
+func gatherAndRecover() bool {
+	reason := gatherData()
+	ok := len(reason) == 0
+	if !ok {
+		recordReadError(reason)
+	}
+	updateAvailability(ok)
+	if options.ExpireAfter > 0 {
+		maxAge := time.Duration(options.ExpireAfter*options.Interval) * time.Second
+		gaugeExpiry.expire(maxAge)
+		energyCounters.expire(maxAge)
+	}
+	// a telegram without plausible readings has been read fine, the port is not to blame
+	if !ok && reason != "no_readings" && options.KeepAlive {
+		log.Printf("Data Gathering failed, resetting port")
+		closeConnection()
+		port = openConnection()
+		connectionResets.WithLabelValues(options.MeterName).Inc()
+	}
+	return ok
+}
+
 func openConnection() io.ReadWriteCloser {
 	timer := prometheus.NewTimer(connectionSetups.WithLabelValues(options.MeterName))
 	defer timer.ObserveDuration()
 
-	// Set up options.
-	options := serial.OpenOptions{
-		PortName:          options.Device,
-		BaudRate:          9600,
-		DataBits:          8,
-		StopBits:          1,
-		ParityMode:        serial.PARITY_NONE,
-		RTSCTSFlowControl: false,
-		MinimumReadSize:   16,
-	}
-
 	// Open the port.
 	logDebug("Connecting serial port...")
-	port, err := serial.Open(options)
+	port, err := openSerial(options.Device, defaultSerialSettings)
 	if err != nil {
 		log.Fatalf("serial.Open: %v", err)
 	}
 	return port
 }
 
+// serialSettings are the line settings of a serial port
+type serialSettings struct {
+	BaudRate uint   `yaml:"baud_rate"`
+	DataBits uint   `yaml:"data_bits"`
+	StopBits uint   `yaml:"stop_bits"`
+	Parity   string `yaml:"parity"`
+}
+
+// defaultSerialSettings are the settings used by SML meters
+var defaultSerialSettings = serialSettings{BaudRate: 9600, DataBits: 8, StopBits: 1, Parity: "none"}
+
+var parityModes = map[string]serial.ParityMode{
+	"none": serial.PARITY_NONE,
+	"odd":  serial.PARITY_ODD,
+	"even": serial.PARITY_EVEN,
+}
+
+func openSerial(device string, settings serialSettings) (io.ReadWriteCloser, error) {
+	parity, ok := parityModes[settings.Parity]
+	if !ok {
+		return nil, fmt.Errorf("Invalid parity %q", settings.Parity)
+	}
+
+	// Set up options.
+	openOptions := serial.OpenOptions{
+		PortName:          device,
+		BaudRate:          settings.BaudRate,
+		DataBits:          settings.DataBits,
+		StopBits:          settings.StopBits,
+		ParityMode:        parity,
+		RTSCTSFlowControl: false,
+		MinimumReadSize:   16,
+	}
+	return serial.Open(openOptions)
+}
+
 func closeConnection() {
 	logDebug("Closing serial port")
 	port.Close()
 }
 
-func gatherData(iteration int) bool {
+// gatherData reads and records one telegram. It returns the reason why the read
+// failed, or an empty string if it succeeded.
+func gatherData() string {
 	timer := prometheus.NewTimer(gatheringDuration.WithLabelValues(options.MeterName))
 	defer timer.ObserveDuration()
 
 	if !options.KeepAlive {
+		// probes of the same device have to wait until the port is closed again
+		lock := deviceLocks.acquire(options.Device)
+		defer deviceLocks.release(options.Device, lock)
 		port = openConnection()
 		defer closeConnection()
 	}
 
 	log.Println("Gathering metrics")
-	message, err := readMessage(port)
+	var message []byte
+	var err error
+	if timeout := readTimeout(); timeout > 0 {
+		message, err = readMessageWithTimeout(port, timeout)
+	} else {
+		message, err = readMessage(port)
+	}
 	if err != nil {
 		log.Printf("Failed to read message, skipping because of %v", err)
-		return false
+		switch {
+		case errors.Is(err, errReadTimeout):
+			return "timeout"
+		case errors.Is(err, errChecksum):
+			return "crc"
+		case errors.Is(err, errFraming):
+			return "framing"
+		default:
+			return "io"
+		}
 	}
 	logDebug("Read full message\n%s\n", formatHexBytes(message, 32))
+	telegramSize.WithLabelValues(options.MeterName).Observe(float64(len(message)))
 
 	smlListResponse, err := extractListResponse(message)
 	if err != nil {
 		log.Printf("Failed to extract list response from message, skipping: %v", err)
-		return false
+		return "no_list_response"
 	}
 
-	for _, meterReading := range extractMeterReadings(smlListResponse) {
+	now := time.Now()
+	telegramTime := now
+	var sensorSeconds *uint64
+	var readings []meterReading
+	response, err := parseListResponse(smlListResponse)
+	if err != nil {
+		log.Warnf("Failed to decode list response, scanning it for energy registers instead: %v", err)
+		readings = scanMeterReadings(smlListResponse, telegramTime)
+	} else {
+		updateMeterIdentity(extractMeterIdentity(response))
+		if timeType, seconds, ok := response.actSensorTime.smlTime(); ok {
+			if timeType == lastSensorTime.timeType && seconds == lastSensorTime.seconds {
+				log.Infof("Skipping duplicate telegram with sensor time %d", seconds)
+				return ""
+			}
+			lastSensorTime = sensorTime{timeType: timeType, seconds: seconds}
+			gaugeSensorTime.WithLabelValues(options.MeterName).Set(float64(seconds))
+			telegramTime = meterClock.timestamp(timeType, seconds, now)
+			sensorSeconds = &seconds
+		}
+		readings = extractMeterReadings(response, telegramTime, &meterClock)
+	}
+
+	recorded := make([]meterReading, 0)
+	derivedPower := make(map[string]float64)
+	for _, meterReading := range readings {
+		if reason, ok := plausibility.check(meterReading); !ok {
+			log.Infof("Rejected value %f for obis %s because of rule %s", meterReading.value, meterReading.name, reason)
+			counterRejectedReadings.WithLabelValues(options.MeterName, meterReading.name, reason).Inc()
+			continue
+		}
 		log.Printf("Recording meter %s with value %f", meterReading.name, meterReading.value)
+		recorded = append(recorded, meterReading)
 		gaugeReading.WithLabelValues(options.MeterName, meterReading.name).Set(meterReading.value)
-		publishData(meterReading, iteration)
+		gaugeExpiry.touch(gaugeReading, options.MeterName, meterReading.name)
+		if meterReading.hasStatus {
+			recordStatusFlags(gaugeStatusFlag, gaugeExpiry, options.MeterName, meterReading)
+		}
+		recordObisInfo(meterReading)
+		energyCounters.record(options.MeterName, meterReading)
+		recordPhaseReading(phaseMetrics, gaugeExpiry, options.MeterName, meterReading)
+		if remoteWrite != nil {
+			remoteWrite.enqueue(options.MeterName, meterReading)
+		}
+		if influxOutput != nil {
+			influxOutput.write(options.MeterName, meterReading)
+		}
+		if options.DerivedPower && meterReading.unit == SML_UNIT_WATT_HOUR {
+			if power, ok := derivePower(meterReading); ok {
+				gaugeDerivedPower.WithLabelValues(options.MeterName, meterReading.name).Set(power)
+				gaugeExpiry.touch(gaugeDerivedPower, options.MeterName, meterReading.name)
+				derivedPower[meterReading.name] = power
+			}
+		}
+	}
+	if len(recorded) == 0 {
+		log.Printf("Message did not contain any plausible readings")
+		return "no_readings"
 	}
-	return true
+	if interval, ok := lastTelegram.advance(telegramTime, sensorSeconds); ok {
+		telegramInterval.WithLabelValues(options.MeterName).Observe(interval)
+	}
+	publishReadings(telegramTime, sensorSeconds, recorded, derivedPower)
+	counterReadSuccess.WithLabelValues(options.MeterName).Inc()
+	gaugeLastSuccess.WithLabelValues(options.MeterName).SetToCurrentTime()
+	gaugeUp.WithLabelValues(options.MeterName).Set(1)
+	gaugeLastRead.WithLabelValues(options.MeterName).Set(float64(telegramTime.UnixMilli()) / 1000)
+	stateChanged.Store(true)
+	return ""
+}
+
+func recordReadError(reason string) {
+	counterReadErrors.WithLabelValues(options.MeterName, reason).Inc()
+	gaugeUp.WithLabelValues(options.MeterName).Set(0)
+}
+
+func updateMeterIdentity(identity meterIdentity) {
+	if identity == currentIdentity {
+		return
+	}
+	if otlpEnabled() {
+		restartOtlpExport(identity)
+	}
+	log.Infof("Meter identified with server ID %s, manufacturer %q, firmware %q", identity.serverID, identity.manufacturer, identity.firmware)
+	setMeterInfo(meterInfo, options.MeterName, identity)
+	currentIdentity = identity
+}
+
+func setMeterInfo(gauge *prometheus.GaugeVec, meterName string, identity meterIdentity) {
+	gauge.DeletePartialMatch(prometheus.Labels{"meter_name": meterName})
+	gauge.WithLabelValues(meterName, identity.serverID, identity.manufacturer, identity.firmware).Set(1)
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogramOf returns the observations of a single histogram series
+func histogramOf(t *testing.T, observer prometheus.Observer) *dto.Histogram {
+	metric := &dto.Metric{}
+	if err := observer.(prometheus.Metric).Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram()
+}
+
+func TestGatherDataHistograms(t *testing.T) {
+	defer func(meterName string, keepAlive bool) {
+		options.MeterName, options.KeepAlive = meterName, keepAlive
+	}(options.MeterName, options.KeepAlive)
+	defer func(clock sensorClock, sensorTime sensorTime, telegram telegramClock) {
+		meterClock, lastSensorTime, lastTelegram = clock, sensorTime, telegram
+	}(meterClock, lastSensorTime, lastTelegram)
+	options.MeterName = "histograms"
+	options.KeepAlive = true
+	// the histograms are global, start with empty series on every run
+	telegramSize.DeleteLabelValues("histograms")
+	gatheringDuration.DeleteLabelValues("histograms")
+	port = prepareTestdata("testdata/smlfile-1", t)
+
+	if reason := gatherData(); len(reason) > 0 {
+		t.Fatalf("gatherData failed with %s", reason)
+	}
+
+	size := histogramOf(t, telegramSize.WithLabelValues("histograms"))
+	if size.GetSampleCount() != 1 || size.GetSampleSum() != float64(len(readTestdata("testdata/smlfile-1", t))) {
+		t.Errorf("telegram size histogram has %d samples with sum %f", size.GetSampleCount(), size.GetSampleSum())
+	}
+	// the native histogram is filled along with the classic buckets
+	if size.GetSchema() == 0 && len(size.GetPositiveSpan()) == 0 {
+		t.Error("telegram size histogram has no native buckets")
+	}
+	duration := histogramOf(t, gatheringDuration.WithLabelValues("histograms"))
+	if duration.GetSampleCount() != 1 || len(duration.GetBucket()) != 10 {
+		t.Errorf("gathering duration histogram has %d samples in %d buckets", duration.GetSampleCount(), len(duration.GetBucket()))
+	}
+}
+
+func TestTelegramClockAdvance(t *testing.T) {
+	seconds := func(s uint64) *uint64 { return &s }
+	start := time.Unix(1700000000, 0)
+	clock := telegramClock{}
+	for i, step := range []struct {
+		time          time.Time
+		sensorSeconds *uint64
+		interval      float64
+		ok            bool
+	}{
+		{start, seconds(1000), 0, false},
+		// the meter's clock wins over the jitter of the reads
+		{start.Add(12 * time.Second), seconds(1010), 10, true},
+		{start.Add(20 * time.Second), nil, 8, true},
+		{start.Add(30 * time.Second), seconds(1030), 10, true},
+		// a meter reset does not produce an interval
+		{start.Add(40 * time.Second), seconds(5), 0, false},
+	} {
+		interval, ok := clock.advance(step.time, step.sensorSeconds)
+		if ok != step.ok || interval != step.interval {
+			t.Errorf("Step %d returned interval %f (%t) instead of %f (%t)", i, interval, ok, step.interval, step.ok)
+		}
+	}
+}
@@ -1,18 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	json "encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
 )
 
-var mqttClient mqtt.Client
+var mqttClient mqttConnection
+
+// mqttTLSConfig is set up once by loadMqttCredentials
+var mqttTLSConfig *tls.Config
+
+// discoveryConfigs holds the last discovery config by topic, to republish them when needed
+var (
+	discoveryLock    sync.Mutex
+	discoveryConfigs = make(map[string][]byte)
+)
 
 var (
 	gaugeMqttConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
@@ -35,100 +53,499 @@ var (
 		})
 )
 
-var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
+// onMqttConnect is called by the client whenever the connection has been (re)established
+func onMqttConnect() {
 	log.Info("MQTT connected")
+	gaugeMqttConnected.WithLabelValues(options.MeterName).Set(1)
+	publishAvailability(readingsAvailable())
+	homeassistantStatus := options.MqttDiscoveryTopicPrefix + "/status"
+	if err := mqttClient.Subscribe(homeassistantStatus, homeassistantStatusHandler); err != nil {
+		log.Warnf("Failed to subscribe to %s: %v", homeassistantStatus, err)
+	}
+	republishDiscoveryData()
+	drainMqttQueueInBackground()
 }
 
-var connectionLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
+// homeassistantStatusHandler republishes the discovery configs when homeassistant comes online again
+func homeassistantStatusHandler(payload []byte) {
+	if string(payload) == "online" {
+		log.Info("Homeassistant came online, republishing discovery data")
+		republishDiscoveryData()
+	}
+}
+
+func onMqttConnectionLost(err error) {
 	log.Warnf("MQTT connection lost: %v", err)
 	gaugeMqttConnected.WithLabelValues(options.MeterName).Set(0)
 }
 
-func connectMqtt() {
-	clientOptions := mqtt.NewClientOptions()
-	var protocol string
-	if options.MqttTls {
-		protocol = "tls"
-	} else {
-		protocol = "tcp"
+// validateMqttOptions rejects combinations of options which would be silently ignored
+func validateMqttOptions() error {
+	if options.MqttMessageExpiry < 0 || options.MqttMessageExpiry > math.MaxUint32 {
+		return fmt.Errorf("Invalid --mqttMessageExpiry %d, it must be between 0 and %d seconds", options.MqttMessageExpiry, uint32(math.MaxUint32))
 	}
-	clientOptions.AddBroker(fmt.Sprintf("%s://%s:%d", protocol, options.MqttHost, options.MqttPort))
-	if options.MqttTlsInsecure && options.MqttTls {
-		clientOptions.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	if options.MqttMessageExpiry > 0 && options.MqttVersion != "5" {
+		return errors.New("--mqttMessageExpiry requires --mqttVersion=5")
 	}
-	if len(options.MqttUser) > 0 && len(options.MqttPassword) > 0 {
-		clientOptions.SetUsername(options.MqttUser)
-		clientOptions.SetPassword(options.MqttPassword)
+	if options.MqttQueueSize > 0 && options.MqttVersion != "5" && options.MqttPayload != "json" {
+		log.Warn("Queued readings are published without the time they were taken, use --mqttPayload=json or --mqttVersion=5 to keep it")
 	}
-	clientOptions.SetOnConnectHandler(connectHandler)
-	clientOptions.SetConnectionLostHandler(connectionLostHandler)
-	mqttClient = mqtt.NewClient(clientOptions)
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Errorf("Connect to MQTT failed: %s", token.Error())
-	} else {
+	return nil
+}
+
+// loadMqttCredentials reads the CA, client certificate and password files given
+// in the options, so a misconfiguration is reported right at the start.
+func loadMqttCredentials() error {
+	if len(options.MqttPasswordFile) > 0 {
+		content, err := os.ReadFile(options.MqttPasswordFile)
+		if err != nil {
+			return err
+		}
+		options.MqttPassword = strings.TrimRight(string(content), "\r\n")
+	}
+	if !options.MqttTls {
+		if len(options.MqttCaFile) > 0 || len(options.MqttCertFile) > 0 {
+			log.Warn("Ignoring MQTT certificates as --mqttTls is not set")
+		}
+		return nil
+	}
+
+	mqttTLSConfig = &tls.Config{
+		InsecureSkipVerify: options.MqttTlsInsecure,
+		ServerName:         options.MqttServerName,
+	}
+	if len(options.MqttCaFile) > 0 {
+		content, err := os.ReadFile(options.MqttCaFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return fmt.Errorf("No certificates found in %s", options.MqttCaFile)
+		}
+		mqttTLSConfig.RootCAs = pool
+	}
+	if len(options.MqttCertFile) > 0 || len(options.MqttKeyFile) > 0 {
+		if len(options.MqttCertFile) == 0 || len(options.MqttKeyFile) == 0 {
+			return errors.New("Client certificates need both --mqttCertFile and --mqttKeyFile")
+		}
+		certificate, err := tls.LoadX509KeyPair(options.MqttCertFile, options.MqttKeyFile)
+		if err != nil {
+			return err
+		}
+		mqttTLSConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return nil
+}
+
+func connectMqtt() {
+	if mqttClient == nil {
+		if options.MqttVersion == "5" {
+			mqttClient = newMqttV5Client()
+		} else {
+			mqttClient = newMqttV3Client()
+		}
+	}
+	if err := mqttClient.Connect(); err != nil {
+		log.Errorf("Connect to MQTT failed: %s", err)
+	} else if mqttClient.IsConnected() {
 		gaugeMqttConnected.WithLabelValues(options.MeterName).Set(1)
 	}
 }
 
+// mqttClientID returns the configured client ID or one derived from the host
+// and meter name, which stays the same across restarts so broker ACLs can refer
+// to it. The hostname keeps exporters on different hosts from taking over each
+// other's connection, as the meter name defaults to the same value everywhere.
+func mqttClientID() string {
+	if len(options.MqttClientID) > 0 {
+		return options.MqttClientID
+	}
+	clientID := "powermeter_exporter"
+	if hostname, err := os.Hostname(); err == nil && len(hostname) > 0 {
+		clientID += "_" + hostname
+	}
+	if len(options.MeterName) > 0 {
+		clientID += "_" + options.MeterName
+	}
+	return clientID
+}
+
+// disconnectMqtt announces that no more readings will follow and closes the connection
+func disconnectMqtt() {
+	if mqttClient == nil || !mqttClient.IsConnected() {
+		return
+	}
+	if token := publishAvailability(false); token != nil && !token.WaitTimeout(5*time.Second) {
+		log.Warn("Timed out publishing MQTT availability")
+	}
+	mqttClient.Disconnect()
+}
+
+// availabilityTopic carries online or offline, depending on whether the published readings are current
+func availabilityTopic() string {
+	return fmt.Sprintf("%s/%s/status", options.MqttTopicPrefix, options.MeterName)
+}
+
+// publishAvailability publishes the retained availability state, it returns nil if not connected
+func publishAvailability(online bool) mqttToken {
+	if mqttClient == nil || !mqttClient.IsConnected() {
+		return nil
+	}
+	payload := "offline"
+	if online {
+		payload = "online"
+	}
+	log.Debugf("Publishing %s to %s", payload, availabilityTopic())
+	return mqttClient.Publish(mqttMessage{topic: availabilityTopic(), payload: []byte(payload), qos: options.MqttQos, retain: true})
+}
+
+// consecutiveReadFailures counts the failed reads since the last successful one
+var consecutiveReadFailures atomic.Int64
+
+// readingsAvailable is false after --mqttOfflineAfter consecutive failed reads
+func readingsAvailable() bool {
+	return options.MqttOfflineAfter == 0 || consecutiveReadFailures.Load() < options.MqttOfflineAfter
+}
+
+// updateAvailability marks the readings offline after --mqttOfflineAfter consecutive
+// failed reads and online again with the next successful one.
+func updateAvailability(ok bool) {
+	if options.MqttOfflineAfter == 0 {
+		return
+	}
+	if ok {
+		if consecutiveReadFailures.Swap(0) >= options.MqttOfflineAfter {
+			log.Info("Reading succeeded again, marking readings as online")
+			publishAvailability(true)
+		}
+		return
+	}
+	if consecutiveReadFailures.Add(1) == options.MqttOfflineAfter {
+		log.Warnf("Reading failed %d times in a row, marking readings as offline", options.MqttOfflineAfter)
+		publishAvailability(false)
+	}
+}
+
 func generateDevice() map[string]interface{} {
-	return map[string]interface{}{
-		"identifiers": []string{options.MeterName},
-		"name":        "Powermeter",
+	identifiers := []string{options.MeterName}
+	device := map[string]interface{}{
+		"name": "Powermeter",
 	}
+	if len(currentIdentity.serverID) > 0 {
+		identifiers = append(identifiers, currentIdentity.serverID)
+		device["serial_number"] = currentIdentity.serverID
+	}
+	if len(currentIdentity.manufacturer) > 0 {
+		device["manufacturer"] = currentIdentity.manufacturer
+	}
+	if len(currentIdentity.firmware) > 0 {
+		device["sw_version"] = currentIdentity.firmware
+	}
+	device["identifiers"] = identifiers
+	return device
 }
 
-func sendDiscoveryData(identifier string, stateTopic string) {
+// sensorClass describes how homeassistant should present readings of a unit
+type sensorClass struct {
+	deviceClass string
+	stateClass  string
+	unit        string
+	// exponent converts from the unit of the meter to unit, e.g. -3 for Wh to kWh
+	exponent int
+}
 
-	oid := strings.Replace(identifier, ".", "_", -1)
+var sensorClasses = map[byte]sensorClass{
+	SML_UNIT_WATT_HOUR: {deviceClass: "energy", stateClass: "total_increasing", unit: "kWh", exponent: -3},
+	SML_UNIT_WATT:      {deviceClass: "power", stateClass: "measurement", unit: "W"},
+	SML_UNIT_VOLT:      {deviceClass: "voltage", stateClass: "measurement", unit: "V"},
+	SML_UNIT_AMPERE:    {deviceClass: "current", stateClass: "measurement", unit: "A"},
+}
 
-	discoveryTopic := strings.Join([]string{options.MqttDiscoveryTopicPrefix, "sensor", options.MeterName, oid, "config"}, "/")
+// valueTemplate returns a template converting the published value to the unit
+// homeassistant expects. Plain payloads are the raw value divided by --factor,
+// JSON payloads carry the value in the unit of the meter. It returns false if
+// the published value can be used as it is.
+func valueTemplate(reading meterReading, exponent int) (string, bool) {
+	digits := 0
+	if exponent+int(reading.scaler) < 0 {
+		digits = -(exponent + int(reading.scaler))
+	}
+	value := "value | float"
+	multiplier := 1.0
+	if options.MqttPayload == "json" {
+		value = fmt.Sprintf("value_json.readings['%s'].value", reading.name)
+	} else {
+		multiplier = float64(options.Factor)
+		exponent += int(reading.scaler)
+	}
+	if exponent < 0 {
+		multiplier /= math.Pow10(-exponent)
+	} else {
+		multiplier *= math.Pow10(exponent)
+	}
+	if multiplier == 1 {
+		if options.MqttPayload == "json" {
+			return guardJSONTemplate(fmt.Sprintf("'%s' in value_json.readings", reading.name), fmt.Sprintf("{{ %s }}", value)), true
+		}
+		return "", false
+	}
+	template := fmt.Sprintf("{{ (%s * %s) | round(%d) }}", value, strconv.FormatFloat(multiplier, 'g', -1, 64), digits)
+	if options.MqttPayload == "json" {
+		template = guardJSONTemplate(fmt.Sprintf("'%s' in value_json.readings", reading.name), template)
+	}
+	return template, true
+}
+
+// guardJSONTemplate keeps the current state of the entity if the JSON payload
+// lacks its value, e.g. because the reading was rejected in this telegram
+func guardJSONTemplate(condition string, template string) string {
+	return fmt.Sprintf("{%% if %s %%}%s{%% else %%}{{ states(entity_id) }}{%% endif %%}", condition, template)
+}
+
+// invalidObjectIDCharacters are those homeassistant does not accept in object and unique IDs
+var invalidObjectIDCharacters = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// objectID turns the name of a reading, e.g. 1.8.0 or 1-1:1.8.0*255, into an ID
+// usable in the discovery topic and as object_id
+func objectID(name string) string {
+	return invalidObjectIDCharacters.ReplaceAllString(name, "_")
+}
+
+// sendDiscoveryData publishes the discovery config of a reading if it is new or
+// has changed, e.g. because the identity of the meter became known.
+func sendDiscoveryData(reading meterReading, stateTopic string) {
+	oid := objectID(reading.name)
+	sensorConfigPayload := newSensorConfig(oid, lookupObis(reading.obis).Name, stateTopic)
+	if class, ok := sensorClasses[reading.unit]; ok {
+		sensorConfigPayload["device_class"] = class.deviceClass
+		sensorConfigPayload["state_class"] = class.stateClass
+		sensorConfigPayload["unit_of_measurement"] = class.unit
+		if template, ok := valueTemplate(reading, class.exponent); ok {
+			sensorConfigPayload["value_template"] = template
+		}
+	}
+	if reading.hasStatus {
+		if options.MqttPayload == "json" {
+			sensorConfigPayload["json_attributes_topic"] = stateTopic
+			sensorConfigPayload["json_attributes_template"] = fmt.Sprintf("{%% if '%[1]s' in value_json.readings %%}{{ value_json.readings['%[1]s'].status | tojson }}{%% else %%}{}{%% endif %%}", reading.name)
+		} else {
+			sensorConfigPayload["json_attributes_topic"] = stateTopic + "/attributes"
+		}
+	}
+	updateDiscoveryConfig(oid, sensorConfigPayload)
+}
 
-	sensorConfigPayload := map[string]interface{}{
-		"device_class":        "energy",
-		"state_class":         "total_increasing",
-		"state_topic":         stateTopic,
-		"unit_of_measurement": "kWh",
-		"name":                identifier,
-		"unique_id":           options.MeterName + "_" + oid,
-		"object_id":           options.MeterName + "_" + oid,
-		"enabled_by_default":  "true",
-		"device":              generateDevice(),
+// sendDerivedPowerDiscoveryData publishes the discovery config of the power
+// derived from an energy register, which is published in W as it is.
+func sendDerivedPowerDiscoveryData(reading meterReading, stateTopic string) {
+	oid := objectID(reading.name) + "_power"
+	sensorConfigPayload := newSensorConfig(oid, lookupObis(reading.obis).Name+" power", stateTopic)
+	class := sensorClasses[SML_UNIT_WATT]
+	sensorConfigPayload["device_class"] = class.deviceClass
+	sensorConfigPayload["state_class"] = class.stateClass
+	sensorConfigPayload["unit_of_measurement"] = class.unit
+	if options.MqttPayload == "json" {
+		sensorConfigPayload["value_template"] = guardJSONTemplate(
+			fmt.Sprintf("'power' in value_json.readings.get('%s', {})", reading.name),
+			fmt.Sprintf("{{ value_json.readings['%s'].power }}", reading.name))
 	}
+	updateDiscoveryConfig(oid, sensorConfigPayload)
+}
+
+// newSensorConfig returns the parts of a discovery config common to all sensors
+func newSensorConfig(oid string, name string, stateTopic string) map[string]interface{} {
+	return map[string]interface{}{
+		"state_topic":        stateTopic,
+		"name":               name,
+		"unique_id":          options.MeterName + "_" + oid,
+		"object_id":          options.MeterName + "_" + oid,
+		"enabled_by_default": "true",
+		"device":             generateDevice(),
+		"availability_topic": availabilityTopic(),
+	}
+}
 
+// updateDiscoveryConfig caches the discovery config of a sensor and publishes it if it changed
+func updateDiscoveryConfig(oid string, sensorConfigPayload map[string]interface{}) {
+	discoveryTopic := strings.Join([]string{options.MqttDiscoveryTopicPrefix, "sensor", options.MeterName, oid, "config"}, "/")
 	discoveryContent, _ := json.Marshal(sensorConfigPayload)
-	mqttClient.Publish(discoveryTopic, 0, false, discoveryContent)
+	discoveryLock.Lock()
+	changed := !bytes.Equal(discoveryConfigs[discoveryTopic], discoveryContent)
+	discoveryConfigs[discoveryTopic] = discoveryContent
+	discoveryLock.Unlock()
+	if changed {
+		publishDiscoveryConfig(discoveryTopic, discoveryContent)
+	}
+}
+
+// publishDiscoveryConfig sends a single discovery config, if connected
+func publishDiscoveryConfig(topic string, content []byte) {
+	if mqttClient == nil || !mqttClient.IsConnected() {
+		return
+	}
+	log.Debugf("Publishing discovery config to %s", topic)
+	mqttClient.Publish(mqttMessage{topic: topic, payload: content, qos: options.MqttDiscoveryQos, retain: options.MqttDiscoveryRetain, contentType: "application/json"})
+}
+
+// republishDiscoveryData sends all known discovery configs again
+func republishDiscoveryData() {
+	discoveryLock.Lock()
+	defer discoveryLock.Unlock()
+	for topic, content := range discoveryConfigs {
+		publishDiscoveryConfig(topic, content)
+	}
 }
 
-func publishData(reading meterReading, iteration int) {
-	withDiscoveryData := (iteration%10 == 0)
-	log.Debugf("publishing in iteration %d, with discovery set to %t", iteration, withDiscoveryData)
+// telegramPayload is the JSON state of all readings of a telegram
+type telegramPayload struct {
+	Time       time.Time                 `json:"time"`
+	SensorTime *uint64                   `json:"sensor_time,omitempty"`
+	Readings   map[string]readingPayload `json:"readings"`
+}
+
+type readingPayload struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+	// time the reading was taken, if it differs from the time of the telegram
+	Time   *time.Time             `json:"time,omitempty"`
+	Status map[string]interface{} `json:"status,omitempty"`
+	// power derived from the register, see --derivedPower
+	Power *float64 `json:"power,omitempty"`
+}
 
+// publishReadings publishes the readings of a telegram and the power derived
+// from them, either each on its own topic or all together as JSON to <prefix>/<meter>/state.
+func publishReadings(telegramTime time.Time, sensorSeconds *uint64, readings []meterReading, derivedPower map[string]float64) {
+	if options.MqttPayload != "json" {
+		for _, reading := range readings {
+			publishData(reading)
+			if power, ok := derivedPower[reading.name]; ok {
+				publishDerivedPower(reading, power)
+			}
+		}
+		return
+	}
+
+	payload := telegramPayload{Time: telegramTime, SensorTime: sensorSeconds, Readings: make(map[string]readingPayload, len(readings))}
+	for _, reading := range readings {
+		entry := readingPayload{Value: reading.scaledValue(), Unit: unitSymbols[reading.unit]}
+		if !reading.time.Equal(telegramTime) {
+			readingTime := reading.time
+			entry.Time = &readingTime
+		}
+		if reading.hasStatus {
+			entry.Status = statusAttributes(reading)
+		}
+		if power, ok := derivedPower[reading.name]; ok {
+			entry.Power = &power
+		}
+		payload.Readings[reading.name] = entry
+	}
+	content, _ := json.Marshal(payload)
+	topic := fmt.Sprintf("%s/%s/state", options.MqttTopicPrefix, options.MeterName)
+	message := newStateMessage(topic, content)
+	message.contentType = "application/json"
+	message.created = telegramTime
+	if !publishMessage(message) {
+		return
+	}
+	for _, reading := range readings {
+		sendDiscoveryData(reading, topic)
+		if _, ok := derivedPower[reading.name]; ok {
+			sendDerivedPowerDiscoveryData(reading, topic)
+		}
+	}
+}
+
+// newStateMessage returns a message with the QoS, retain flag and expiry configured for readings
+func newStateMessage(topic string, payload []byte) mqttMessage {
+	return mqttMessage{topic: topic, payload: payload, qos: options.MqttQos, retain: options.MqttRetain, expiry: uint32(options.MqttMessageExpiry)}
+}
+
+// readingProperties are the MQTT 5 user properties describing a reading, including
+// the time it was taken, as queued readings may be delivered much later
+func readingProperties(obis string, unit string, readingTime time.Time) [][2]string {
+	return [][2]string{{"obis", obis}, {"unit", unit}, {"time", readingTime.UTC().Format(time.RFC3339Nano)}}
+}
+
+func publishData(reading meterReading) {
+	topic := fmt.Sprintf("%s/%s/%s", options.MqttTopicPrefix, options.MeterName, reading.name)
+	message := newStateMessage(topic, []byte(fmt.Sprintf("%f", reading.value)))
+	message.contentType = "text/plain"
+	message.created = reading.time
+	message.userProperties = readingProperties(reading.name, unitSymbols[reading.unit], reading.time)
+	if !publishMessage(message) {
+		return
+	}
+	if reading.hasStatus {
+		attributes, _ := json.Marshal(statusAttributes(reading))
+		message = newStateMessage(topic+"/attributes", attributes)
+		message.contentType = "application/json"
+		message.created = reading.time
+		message.userProperties = readingProperties(reading.name, unitSymbols[reading.unit], reading.time)
+		publishMessage(message)
+	}
+	sendDiscoveryData(reading, topic)
+}
+
+// publishDerivedPower publishes the power derived from an energy register to <prefix>/<meter>/<obis>/power
+func publishDerivedPower(reading meterReading, power float64) {
+	topic := fmt.Sprintf("%s/%s/%s/power", options.MqttTopicPrefix, options.MeterName, reading.name)
+	message := newStateMessage(topic, []byte(fmt.Sprintf("%f", power)))
+	message.contentType = "text/plain"
+	message.created = reading.time
+	message.userProperties = readingProperties(reading.name, unitSymbols[SML_UNIT_WATT], reading.time)
+	if !publishMessage(message) {
+		return
+	}
+	sendDerivedPowerDiscoveryData(reading, topic)
+}
+
+// publishMessage sends the message, reconnecting if necessary. While the broker
+// is unreachable, the message is queued if --mqttQueueSize is set, and sent after
+// all earlier queued messages once connected again.
+// It returns false if the message could neither be sent nor queued.
+func publishMessage(message mqttMessage) bool {
 	if mqttClient == nil {
 		log.Debug("MQTTClient not initialized, skipping")
-		return
+		return false
 	}
 	if !mqttClient.IsConnected() {
 		log.Info("MQTTClient disconnected, reconnecting")
 		connectMqtt()
 	}
 
-	topic := fmt.Sprintf("%s/%s/%s", options.MqttTopicPrefix, options.MeterName, reading.name)
-	if mqttClient != nil && mqttClient.IsConnected() {
-		log.Debugf("Publishing %f to %s", reading.value, topic)
-		t := mqttClient.Publish(topic, 0, false, fmt.Sprintf("%f", reading.value))
+	if mqttQueue != nil {
+		// messages queue up behind earlier ones until those are sent in the
+		// background, so a slow broker does not hold up the reads
+		mqttQueueLock.Lock()
+		queued := !mqttClient.IsConnected() || mqttQueue.len() > 0
+		if queued {
+			queueMqttMessage(message)
+		}
+		mqttQueueLock.Unlock()
+		if queued {
+			if mqttClient.IsConnected() {
+				drainMqttQueueInBackground()
+			}
+			return true
+		}
+	}
+
+	if mqttClient.IsConnected() {
+		log.Debugf("Publishing %s to %s", message.payload, message.topic)
+		t := mqttClient.Publish(message)
 		counterMqttMessages.WithLabelValues(options.MeterName).Inc()
 		go func() {
-			_ = t.Wait() // Can also use '<-t.Done()' in releases > 1.2.0
+			_ = t.Wait()
 			if t.Error() != nil {
-				log.Error(t.Error()) // Use your preferred logging technique (or just fmt.Printf)
+				log.Error(t.Error())
 			}
 		}()
-
-		if withDiscoveryData {
-			sendDiscoveryData(reading.name, topic)
-		}
-
-	} else {
-		log.Debugf("Not publishing to %s, not connected", topic)
+		return true
 	}
+
+	log.Debugf("Not publishing to %s, not connected", message.topic)
+	return false
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	log "github.com/sirupsen/logrus"
+)
+
+var errMqttNotConnected = errors.New("Not connected")
+
+// mqttV5Client speaks MQTT 5 using paho.golang, which reconnects on its own
+type mqttV5Client struct {
+	config autopaho.ClientConfig
+	// connection is set by the first OnConnectionUp, which may run before
+	// autopaho.NewConnection returned
+	connection atomic.Pointer[autopaho.ConnectionManager]
+	connected  atomic.Bool
+	// publications are sent one after another to keep their order
+	outgoing chan mqttV5Publication
+
+	handlersLock sync.Mutex
+	handlers     map[string]func(payload []byte)
+}
+
+// mqttV5Token completes when the broker acknowledged a message, or right after
+// sending it with QoS 0
+type mqttV5Token struct {
+	done chan struct{}
+	err  error
+}
+
+type mqttV5Publication struct {
+	publish *paho.Publish
+	token   *mqttV5Token
+	// the publication is abandoned at the deadline, even if it was not sent yet
+	deadline time.Time
+}
+
+var errMqttBacklog = errors.New("Too many pending publications")
+
+func newMqttV5Client() *mqttV5Client {
+	scheme := "mqtt"
+	if options.MqttTls {
+		scheme = "tls"
+	}
+	server := &url.URL{Scheme: scheme, Host: net.JoinHostPort(options.MqttHost, strconv.FormatInt(options.MqttPort, 10))}
+
+	c := &mqttV5Client{handlers: make(map[string]func(payload []byte)), outgoing: make(chan mqttV5Publication, 100)}
+	go c.sendPublications()
+	c.config = autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{server},
+		TlsCfg:                        mqttTLSConfig,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: true,
+		WillMessage:                   &paho.WillMessage{Topic: availabilityTopic(), Payload: []byte("offline"), QoS: options.MqttQos, Retain: true},
+		OnConnectionUp: func(connection *autopaho.ConnectionManager, _ *paho.Connack) {
+			c.connection.Store(connection)
+			c.connected.Store(true)
+			// must not block, but subscribing waits for the broker
+			go onMqttConnect()
+		},
+		OnConnectionDown: func() bool {
+			c.connected.Store(false)
+			onMqttConnectionLost(errors.New("Connection closed"))
+			return true
+		},
+		OnConnectError: func(err error) {
+			log.Warnf("MQTT connection attempt failed: %v", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          mqttClientID(),
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){c.received},
+		},
+	}
+	if len(options.MqttUser) > 0 && len(options.MqttPassword) > 0 {
+		c.config.ConnectUsername = options.MqttUser
+		c.config.ConnectPassword = []byte(options.MqttPassword)
+	}
+	return c
+}
+
+// Connect starts the connection manager and waits for the first connection.
+// Once started, the manager keeps reconnecting in the background.
+func (c *mqttV5Client) Connect() error {
+	if c.connection.Load() != nil {
+		if c.IsConnected() {
+			return nil
+		}
+		return errors.New("Not connected, reconnecting in the background")
+	}
+	connection, err := autopaho.NewConnection(context.Background(), c.config)
+	if err != nil {
+		return err
+	}
+	c.connection.Store(connection)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return connection.AwaitConnection(ctx)
+}
+
+func (c *mqttV5Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *mqttV5Client) Publish(message mqttMessage) mqttToken {
+	publish := &paho.Publish{
+		Topic:   message.topic,
+		QoS:     message.qos,
+		Retain:  message.retain,
+		Payload: message.payload,
+	}
+	if len(message.contentType) > 0 || message.expiry > 0 || len(message.userProperties) > 0 {
+		publish.Properties = &paho.PublishProperties{ContentType: message.contentType}
+		if message.expiry > 0 {
+			expiry := message.expiry
+			publish.Properties.MessageExpiry = &expiry
+		}
+		for _, property := range message.userProperties {
+			publish.Properties.User.Add(property[0], property[1])
+		}
+	}
+
+	token := &mqttV5Token{done: make(chan struct{})}
+	select {
+	case c.outgoing <- mqttV5Publication{publish: publish, token: token, deadline: time.Now().Add(mqttPublishTimeout)}:
+	default:
+		// the broker does not keep up, fail instead of blocking the reads
+		token.err = errMqttBacklog
+		close(token.done)
+	}
+	return token
+}
+
+// sendPublications publishes the queued publications in order, waiting for the
+// acknowledgement of each before sending the next
+func (c *mqttV5Client) sendPublications() {
+	for publication := range c.outgoing {
+		connection := c.connection.Load()
+		if connection == nil {
+			publication.token.err = errMqttNotConnected
+			close(publication.token.done)
+			continue
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), publication.deadline)
+		_, publication.token.err = connection.Publish(ctx, publication.publish)
+		cancel()
+		close(publication.token.done)
+	}
+}
+
+func (c *mqttV5Client) Subscribe(topic string, handler func(payload []byte)) error {
+	c.handlersLock.Lock()
+	c.handlers[topic] = handler
+	c.handlersLock.Unlock()
+	connection := c.connection.Load()
+	if connection == nil {
+		return errMqttNotConnected
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := connection.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: 0}}})
+	return err
+}
+
+func (c *mqttV5Client) received(received paho.PublishReceived) (bool, error) {
+	c.handlersLock.Lock()
+	handler, ok := c.handlers[received.Packet.Topic]
+	c.handlersLock.Unlock()
+	if ok {
+		handler(received.Packet.Payload)
+	}
+	return ok, nil
+}
+
+func (c *mqttV5Client) Disconnect() {
+	connection := c.connection.Load()
+	if connection == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := connection.Disconnect(ctx); err != nil {
+		log.Warnf("Failed to disconnect from MQTT: %v", err)
+	}
+}
+
+func (t *mqttV5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *mqttV5Token) WaitTimeout(timeout time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (t *mqttV5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpdateAvailability(t *testing.T) {
+	defer func(saved int64) { options.MqttOfflineAfter = saved }(options.MqttOfflineAfter)
+	options.MqttOfflineAfter = 2
+	consecutiveReadFailures.Store(0)
+
+	steps := []struct {
+		ok        bool
+		available bool
+	}{
+		{false, true},
+		{false, false},
+		{false, false},
+		{true, true},
+		{false, true},
+	}
+	for i, step := range steps {
+		updateAvailability(step.ok)
+		if readingsAvailable() != step.available {
+			t.Errorf("Step %d: availability is %t instead of %t", i, readingsAvailable(), step.available)
+		}
+	}
+}
+
+func TestSendDiscoveryDataCachesConfigs(t *testing.T) {
+	options.MeterName = "test"
+	options.MqttDiscoveryTopicPrefix = "homeassistant"
+	defer func() { options.MeterName, options.MqttDiscoveryTopicPrefix = "", "" }()
+	discoveryConfigs = make(map[string][]byte)
+
+	reading := meterReading{name: "1.8.0", obis: mustParseObisCode("1.8.0")}
+	sendDiscoveryData(reading, "powermeter/test/1.8.0")
+	sendDiscoveryData(reading, "powermeter/test/1.8.0")
+	if len(discoveryConfigs) != 1 {
+		t.Fatalf("Expected 1 cached discovery config, got %d", len(discoveryConfigs))
+	}
+	if _, ok := discoveryConfigs["homeassistant/sensor/test/1_8_0/config"]; !ok {
+		t.Errorf("Discovery config is cached under an unexpected topic: %v", discoveryConfigs)
+	}
+}
+
+func TestDiscoveryMetadata(t *testing.T) {
+	options.MeterName = "test"
+	options.MqttDiscoveryTopicPrefix = "homeassistant"
+	defer func() { options.MeterName, options.MqttDiscoveryTopicPrefix = "", "" }()
+
+	tests := []struct {
+		reading     meterReading
+		name        string
+		deviceClass string
+		stateClass  string
+		unit        string
+		template    string
+	}{
+		{meterReading{name: "1.8.0", obis: mustParseObisCode("1.8.0"), unit: SML_UNIT_WATT_HOUR, scaler: -1}, "Grid import", "energy", "total_increasing", "kWh", "{{ (value | float * 0.0001) | round(4) }}"},
+		{meterReading{name: "2.8.0", obis: mustParseObisCode("2.8.0"), unit: SML_UNIT_WATT_HOUR, scaler: 3}, "Grid export", "energy", "total_increasing", "kWh", ""},
+		{meterReading{name: "16.7.0", obis: mustParseObisCode("16.7.0"), unit: SML_UNIT_WATT}, "Grid power", "power", "measurement", "W", ""},
+		{meterReading{name: "32.7.0", obis: mustParseObisCode("32.7.0"), unit: SML_UNIT_VOLT, scaler: -1}, "Voltage L1", "voltage", "measurement", "V", "{{ (value | float * 0.1) | round(1) }}"},
+		{meterReading{name: "31.7.0", obis: mustParseObisCode("31.7.0"), unit: SML_UNIT_AMPERE, scaler: -2}, "Current L1", "current", "measurement", "A", "{{ (value | float * 0.01) | round(2) }}"},
+	}
+	for _, test := range tests {
+		discoveryConfigs = make(map[string][]byte)
+		sendDiscoveryData(test.reading, "powermeter/test/"+test.reading.name)
+		for _, content := range discoveryConfigs {
+			config := make(map[string]interface{})
+			if err := json.Unmarshal(content, &config); err != nil {
+				t.Fatalf("Invalid discovery config: %v", err)
+			}
+			template, _ := config["value_template"].(string)
+			if config["name"] != test.name || config["device_class"] != test.deviceClass || config["state_class"] != test.stateClass || config["unit_of_measurement"] != test.unit || template != test.template {
+				t.Errorf("Discovery config for %s is %s", test.reading.name, content)
+			}
+		}
+	}
+}
+
+func TestDiscoveryFullObisCode(t *testing.T) {
+	options.MeterName = "test"
+	options.MqttDiscoveryTopicPrefix = "homeassistant"
+	defer func() { options.MeterName, options.MqttDiscoveryTopicPrefix = "", "" }()
+	discoveryConfigs = make(map[string][]byte)
+
+	code := mustParseObisCode("1-1:1.8.0*255")
+	sendDiscoveryData(meterReading{name: code.shortName(), obis: code, unit: SML_UNIT_WATT_HOUR}, "powermeter/test/"+code.shortName())
+	content, ok := discoveryConfigs["homeassistant/sensor/test/1-1_1_8_0_255/config"]
+	if !ok {
+		t.Fatalf("No discovery config for %s, got %v", code, discoveryConfigs)
+	}
+	config := make(map[string]interface{})
+	if err := json.Unmarshal(content, &config); err != nil {
+		t.Fatalf("Invalid discovery config: %v", err)
+	}
+	if config["unique_id"] != "test_1-1_1_8_0_255" || config["object_id"] != "test_1-1_1_8_0_255" {
+		t.Errorf("Discovery config for %s has IDs %v and %v", code, config["unique_id"], config["object_id"])
+	}
+}
+
+func TestJsonDiscoveryTemplates(t *testing.T) {
+	options.MqttPayload = "json"
+	defer func() { options.MqttPayload = "" }()
+
+	tests := []struct {
+		reading  meterReading
+		template string
+	}{
+		{meterReading{name: "1.8.0", unit: SML_UNIT_WATT_HOUR, scaler: -1}, "{% if '1.8.0' in value_json.readings %}{{ (value_json.readings['1.8.0'].value * 0.001) | round(4) }}{% else %}{{ states(entity_id) }}{% endif %}"},
+		{meterReading{name: "16.7.0", unit: SML_UNIT_WATT}, "{% if '16.7.0' in value_json.readings %}{{ value_json.readings['16.7.0'].value }}{% else %}{{ states(entity_id) }}{% endif %}"},
+	}
+	for _, test := range tests {
+		template, ok := valueTemplate(test.reading, sensorClasses[test.reading.unit].exponent)
+		if !ok || template != test.template {
+			t.Errorf("Template for %s is %q instead of %q", test.reading.name, template, test.template)
+		}
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and its key as PEM files
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "powermeter"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestLoadMqttCredentials(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	options.MqttTls = true
+	options.MqttCaFile = certFile
+	options.MqttCertFile = certFile
+	options.MqttKeyFile = keyFile
+	options.MqttServerName = "broker.local"
+	options.MqttPasswordFile = passwordFile
+	if err := loadMqttCredentials(); err != nil {
+		t.Fatalf("loadMqttCredentials failed: %v", err)
+	}
+	if options.MqttPassword != "secret" {
+		t.Errorf("Password is %q instead of secret", options.MqttPassword)
+	}
+	if mqttTLSConfig.RootCAs == nil || len(mqttTLSConfig.Certificates) != 1 || mqttTLSConfig.ServerName != "broker.local" {
+		t.Errorf("TLS config is incomplete: %+v", mqttTLSConfig)
+	}
+
+	options.MqttKeyFile = ""
+	if err := loadMqttCredentials(); err == nil {
+		t.Errorf("loadMqttCredentials accepted a certificate without key")
+	}
+}
+
+// fakeMqttClient records published messages instead of sending them
+type fakeMqttClient struct {
+	connected bool
+	published []mqttMessage
+}
+
+type fakeMqttToken struct{}
+
+func (fakeMqttToken) Wait() bool                               { return true }
+func (fakeMqttToken) WaitTimeout(time.Duration) bool           { return true }
+func (fakeMqttToken) Error() error                             { return nil }
+func (c *fakeMqttClient) Connect() error                       { return nil }
+func (c *fakeMqttClient) IsConnected() bool                    { return c.connected }
+func (c *fakeMqttClient) Disconnect()                          { c.connected = false }
+func (c *fakeMqttClient) Subscribe(string, func([]byte)) error { return nil }
+func (c *fakeMqttClient) Publish(message mqttMessage) mqttToken {
+	c.published = append(c.published, message)
+	return fakeMqttToken{}
+}
+
+func TestPublishDataProperties(t *testing.T) {
+	saved := options
+	defer func() { options, mqttClient = saved, nil }()
+	options.MeterName = "test"
+	options.MqttTopicPrefix = "powermeter"
+	options.MqttMessageExpiry = 300
+	options.MqttQos = 1
+	client := &fakeMqttClient{connected: true}
+	mqttClient = client
+	discoveryConfigs = make(map[string][]byte)
+
+	publishData(meterReading{name: "16.7.0", obis: mustParseObisCode("16.7.0"), value: 412, unit: SML_UNIT_WATT, time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)})
+	if len(client.published) != 2 {
+		t.Fatalf("Expected a state and a discovery message, got %d messages", len(client.published))
+	}
+	state := client.published[0]
+	if state.topic != "powermeter/test/16.7.0" || string(state.payload) != "412.000000" || state.qos != 1 || state.expiry != 300 || state.contentType != "text/plain" {
+		t.Errorf("Unexpected state message %+v", state)
+	}
+	if len(state.userProperties) != 3 || state.userProperties[0] != [2]string{"obis", "16.7.0"} || state.userProperties[1] != [2]string{"unit", "W"} || state.userProperties[2] != [2]string{"time", "2024-05-01T12:00:00Z"} {
+		t.Errorf("Unexpected user properties %v", state.userProperties)
+	}
+	if discovery := client.published[1]; discovery.contentType != "application/json" || discovery.expiry != 0 {
+		t.Errorf("Unexpected discovery message %+v", discovery)
+	}
+}
+
+func TestPublishDerivedPower(t *testing.T) {
+	saved := options
+	defer func() { options, mqttClient = saved, nil }()
+	options.MeterName = "test"
+	options.MqttTopicPrefix = "powermeter"
+	options.MqttDiscoveryTopicPrefix = "homeassistant"
+	client := &fakeMqttClient{connected: true}
+	mqttClient = client
+	discoveryConfigs = make(map[string][]byte)
+
+	publishDerivedPower(meterReading{name: "1.8.0", obis: mustParseObisCode("1.8.0"), unit: SML_UNIT_WATT_HOUR, scaler: -1}, 412)
+	if len(client.published) != 2 {
+		t.Fatalf("Expected a state and a discovery message, got %d messages", len(client.published))
+	}
+	if state := client.published[0]; state.topic != "powermeter/test/1.8.0/power" || string(state.payload) != "412.000000" {
+		t.Errorf("Unexpected state message %+v", state)
+	}
+	discovery := client.published[1]
+	if discovery.topic != "homeassistant/sensor/test/1_8_0_power/config" {
+		t.Errorf("Unexpected discovery topic %s", discovery.topic)
+	}
+	config := map[string]interface{}{}
+	if err := json.Unmarshal(discovery.payload, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["device_class"] != "power" || config["unit_of_measurement"] != "W" || config["name"] != "Grid import power" || config["unique_id"] != "test_1_8_0_power" || config["value_template"] != nil {
+		t.Errorf("Unexpected discovery config %v", config)
+	}
+}
+
+func TestPublishMessageQueuesWhileDisconnected(t *testing.T) {
+	saved := options
+	defer func() { options, mqttClient, mqttQueue = saved, nil, nil }()
+	options.MeterName = "test"
+	options.MqttMessageExpiry = 300
+	client := &fakeMqttClient{}
+	mqttClient = client
+	var err error
+	if mqttQueue, err = newSpoolQueue("mqtt", t.TempDir(), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range []string{"1", "2", "3"} {
+		if !publishMessage(newStateMessage("powermeter/test/1.8.0", []byte(payload))) {
+			t.Fatalf("Message %s was not queued", payload)
+		}
+	}
+	if len(client.published) != 0 || mqttQueue.len() != 2 {
+		t.Fatalf("Expected 2 queued and no published messages, got %d and %d", mqttQueue.len(), len(client.published))
+	}
+
+	client.connected = true
+	publishMessage(newStateMessage("powermeter/test/1.8.0", []byte("4")))
+	// the queue is drained in the background
+	for deadline := time.Now().Add(time.Second); (mqttQueue.len() > 0 || mqttDraining.Load()) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 4 is queued behind 2 and 3, which drops 2 from the full queue
+	if mqttQueue.len() != 0 || len(client.published) != 2 {
+		t.Fatalf("Expected the queue to be drained, got %d queued and %d published messages", mqttQueue.len(), len(client.published))
+	}
+	for i, payload := range []string{"3", "4"} {
+		if message := client.published[i]; string(message.payload) != payload || message.expiry == 0 || message.expiry > 300 {
+			t.Errorf("Unexpected message %d: %+v", i, message)
+		}
+	}
+}
+
+func TestMqttClientID(t *testing.T) {
+	defer func(meterName, clientID string) {
+		options.MeterName, options.MqttClientID = meterName, clientID
+	}(options.MeterName, options.MqttClientID)
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skipf("No hostname: %v", err)
+	}
+
+	options.MeterName = "main"
+	options.MqttClientID = ""
+	if id := mqttClientID(); id != "powermeter_exporter_"+hostname+"_main" {
+		t.Errorf("Default client ID is %s", id)
+	}
+	options.MqttClientID = "acl_user"
+	if id := mqttClientID(); id != "acl_user" {
+		t.Errorf("Configured client ID is %s", id)
+	}
+}
+
+func TestPublishReadingsJsonDerivedPower(t *testing.T) {
+	saved := options
+	defer func() { options, mqttClient = saved, nil }()
+	options.MeterName = "test"
+	options.MqttTopicPrefix = "powermeter"
+	options.MqttDiscoveryTopicPrefix = "homeassistant"
+	options.MqttPayload = "json"
+	client := &fakeMqttClient{connected: true}
+	mqttClient = client
+	discoveryConfigs = make(map[string][]byte)
+
+	now := time.Now()
+	reading := meterReading{name: "1.8.0", obis: mustParseObisCode("1.8.0"), unit: SML_UNIT_WATT_HOUR, raw: 137750, scaler: -1, time: now}
+	publishReadings(now, nil, []meterReading{reading}, map[string]float64{"1.8.0": 412})
+	if len(client.published) != 3 {
+		t.Fatalf("Expected a state and two discovery messages, got %d messages", len(client.published))
+	}
+	payload := telegramPayload{}
+	if err := json.Unmarshal(client.published[0].payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if entry := payload.Readings["1.8.0"]; entry.Power == nil || *entry.Power != 412 {
+		t.Errorf("State has no derived power: %s", client.published[0].payload)
+	}
+	content, ok := discoveryConfigs["homeassistant/sensor/test/1_8_0_power/config"]
+	if !ok {
+		t.Fatalf("No discovery config for the derived power, got %v", discoveryConfigs)
+	}
+	config := map[string]interface{}{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		t.Fatal(err)
+	}
+	expected := "{% if 'power' in value_json.readings.get('1.8.0', {}) %}{{ value_json.readings['1.8.0'].power }}{% else %}{{ states(entity_id) }}{% endif %}"
+	if config["state_topic"] != "powermeter/test/state" || config["value_template"] != expected {
+		t.Errorf("Unexpected discovery config %v", config)
+	}
+}
+
+func TestValidateMqttOptions(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	tests := []struct {
+		version string
+		expiry  int64
+		valid   bool
+	}{
+		{"3.1.1", 0, true},
+		{"5", 300, true},
+		{"5", -1, false},
+		{"5", 1 << 32, false},
+		{"3.1.1", 300, false},
+	}
+	for _, test := range tests {
+		options.MqttVersion = test.version
+		options.MqttMessageExpiry = test.expiry
+		if err := validateMqttOptions(); (err == nil) != test.valid {
+			t.Errorf("Validation of expiry %d with MQTT %s returned %v", test.expiry, test.version, err)
+		}
+	}
+}
+
+func TestDrainMqttQueueExpiry(t *testing.T) {
+	saved := options
+	defer func() { options, mqttClient, mqttQueue = saved, nil, nil }()
+	client := &fakeMqttClient{connected: true}
+	mqttClient = client
+	var err error
+	if mqttQueue, err = newSpoolQueue("mqtt", "", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	options.MqttMessageExpiry = 300
+	stale := newStateMessage("powermeter/test/1.8.0", []byte("1"))
+	stale.created = time.Now().Add(-10 * time.Minute)
+	recent := newStateMessage("powermeter/test/1.8.0", []byte("2"))
+	recent.created = time.Now().Add(-time.Minute)
+	mqttQueueLock.Lock()
+	queueMqttMessage(stale)
+	queueMqttMessage(recent)
+	mqttQueueLock.Unlock()
+	drainMqttQueueBefore(time.Now().Add(time.Second))
+
+	if len(client.published) != 1 || string(client.published[0].payload) != "2" {
+		t.Fatalf("Expected only the recent message to be published, got %+v", client.published)
+	}
+	// the expiry counts from the time the reading was taken
+	if expiry := client.published[0].expiry; expiry > 240 || expiry < 230 {
+		t.Errorf("Queued message was published with expiry %d", expiry)
+	}
+}
+
+func TestMqttV5PublishBacklog(t *testing.T) {
+	client := &mqttV5Client{outgoing: make(chan mqttV5Publication, 1)}
+	if token := client.Publish(mqttMessage{topic: "first"}); token.Error() != nil {
+		t.Errorf("First publication failed: %v", token.Error())
+	}
+	token := client.Publish(mqttMessage{topic: "second"})
+	if !token.WaitTimeout(time.Second) || !errors.Is(token.Error(), errMqttBacklog) {
+		t.Errorf("Publication beyond the backlog returned %v instead of failing", token.Error())
+	}
+}
+
+// blockedMqttClient never gets an acknowledgement from the broker until it is released
+type blockedMqttClient struct {
+	fakeMqttClient
+	release chan struct{}
+}
+
+type blockedMqttToken struct {
+	release chan struct{}
+}
+
+func (t blockedMqttToken) Wait() bool { <-t.release; return true }
+func (t blockedMqttToken) WaitTimeout(timeout time.Duration) bool {
+	select {
+	case <-t.release:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+func (blockedMqttToken) Error() error { return nil }
+func (c *blockedMqttClient) Publish(message mqttMessage) mqttToken {
+	c.published = append(c.published, message)
+	return blockedMqttToken{c.release}
+}
+
+func TestPublishMessageWhileDrainIsBlocked(t *testing.T) {
+	saved := options
+	defer func() { options, mqttClient, mqttQueue = saved, nil, nil }()
+	options.MeterName = "test"
+	client := &blockedMqttClient{fakeMqttClient: fakeMqttClient{connected: true}, release: make(chan struct{})}
+	mqttClient = client
+	var err error
+	if mqttQueue, err = newSpoolQueue("mqtt", "", 10); err != nil {
+		t.Fatal(err)
+	}
+	mqttQueueLock.Lock()
+	queueMqttMessage(newStateMessage("powermeter/test/1.8.0", []byte("1")))
+	mqttQueueLock.Unlock()
+	drainMqttQueueInBackground()
+
+	// the drain waits for the broker to acknowledge 1, new messages must not
+	started := time.Now()
+	for _, payload := range []string{"2", "3"} {
+		if !publishMessage(newStateMessage("powermeter/test/1.8.0", []byte(payload))) {
+			t.Fatalf("Message %s was not queued", payload)
+		}
+	}
+	if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+		t.Errorf("Publishing waited %s for the drain", elapsed)
+	}
+
+	close(client.release)
+	for deadline := time.Now().Add(time.Second); (mqttQueue.len() > 0 || mqttDraining.Load()) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mqttQueue.len() != 0 || len(client.published) != 3 {
+		t.Fatalf("Expected the queue to be drained, got %d queued and %d published messages", mqttQueue.len(), len(client.published))
+	}
+	for i, payload := range []string{"1", "2", "3"} {
+		if string(client.published[i].payload) != payload {
+			t.Errorf("Message %d is %s instead of %s", i, client.published[i].payload, payload)
+		}
+	}
+}
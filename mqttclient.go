@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttMessage is a message to publish. The properties are only sent with MQTT 5.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+	// MQTT 5 properties
+	contentType    string
+	expiry         uint32
+	userProperties [][2]string
+	// time the content was taken, the expiry of queued messages counts from it
+	created time.Time
+}
+
+// mqttPublishTimeout is the time a publication may take until it is given up.
+// MQTT 5 publications are abandoned after it, so waiting a little longer for
+// their token tells for sure whether the message went out.
+const mqttPublishTimeout = 10 * time.Second
+
+// mqttToken tracks the delivery of a published message
+type mqttToken interface {
+	Wait() bool
+	WaitTimeout(time.Duration) bool
+	Error() error
+}
+
+// mqttConnection hides the differences of the client libraries for MQTT 3.1.1 and 5.
+// Clients call onMqttConnect and onMqttConnectionLost on changes of the connection.
+type mqttConnection interface {
+	// Connect establishes the connection, reconnects are up to the client
+	Connect() error
+	IsConnected() bool
+	Publish(message mqttMessage) mqttToken
+	Subscribe(topic string, handler func(payload []byte)) error
+	Disconnect()
+}
+
+// mqttV3Client speaks MQTT 3.1.1 using paho.mqtt.golang
+type mqttV3Client struct {
+	client mqtt.Client
+}
+
+func newMqttV3Client() *mqttV3Client {
+	clientOptions := mqtt.NewClientOptions()
+	var protocol string
+	if options.MqttTls {
+		protocol = "tls"
+	} else {
+		protocol = "tcp"
+	}
+	clientOptions.AddBroker(fmt.Sprintf("%s://%s:%d", protocol, options.MqttHost, options.MqttPort))
+	if options.MqttTls {
+		clientOptions.SetTLSConfig(mqttTLSConfig)
+	}
+	if len(options.MqttUser) > 0 && len(options.MqttPassword) > 0 {
+		clientOptions.SetUsername(options.MqttUser)
+		clientOptions.SetPassword(options.MqttPassword)
+	}
+	clientOptions.SetClientID(mqttClientID())
+	clientOptions.SetWill(availabilityTopic(), "offline", options.MqttQos, true)
+	clientOptions.SetOnConnectHandler(func(client mqtt.Client) {
+		onMqttConnect()
+	})
+	clientOptions.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		onMqttConnectionLost(err)
+	})
+	return &mqttV3Client{client: mqtt.NewClient(clientOptions)}
+}
+
+func (c *mqttV3Client) Connect() error {
+	token := c.client.Connect()
+	token.Wait()
+	return token.Error()
+}
+
+// IsConnected is false while paho reconnects, as it silently drops messages with QoS 0 then
+func (c *mqttV3Client) IsConnected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+func (c *mqttV3Client) Publish(message mqttMessage) mqttToken {
+	return c.client.Publish(message.topic, message.qos, message.retain, message.payload)
+}
+
+func (c *mqttV3Client) Subscribe(topic string, handler func(payload []byte)) error {
+	token := c.client.Subscribe(topic, 0, func(client mqtt.Client, message mqtt.Message) {
+		handler(message.Payload())
+	})
+	token.Wait()
+	return token.Error()
+}
+
+func (c *mqttV3Client) Disconnect() {
+	c.client.Disconnect(250)
+}
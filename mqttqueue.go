@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mqttQueue holds readings published while the broker is unreachable, see --mqttQueueSize
+var mqttQueue *spoolQueue
+
+// mqttQueueLock keeps queued and new messages in order while the queue is drained.
+// It is only held to look at or change the queue, never while publishing.
+var mqttQueueLock sync.Mutex
+
+// mqttDraining is set while the queue is drained, there is only one drain at a time
+var mqttDraining atomic.Bool
+
+// queuedMqttMessage is the persisted form of a queued mqttMessage
+type queuedMqttMessage struct {
+	Topic          string      `json:"topic"`
+	Payload        []byte      `json:"payload"`
+	QoS            byte        `json:"qos"`
+	Retain         bool        `json:"retain"`
+	ContentType    string      `json:"content_type,omitempty"`
+	Expiry         uint32      `json:"expiry,omitempty"`
+	UserProperties [][2]string `json:"user_properties,omitempty"`
+	Created        time.Time   `json:"created"`
+}
+
+// queueMqttMessage appends the message to the queue. The caller must hold mqttQueueLock.
+func queueMqttMessage(message mqttMessage) {
+	created := message.created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	content, err := json.Marshal(queuedMqttMessage{
+		Topic:          message.topic,
+		Payload:        message.payload,
+		QoS:            message.qos,
+		Retain:         message.retain,
+		ContentType:    message.contentType,
+		Expiry:         message.expiry,
+		UserProperties: message.userProperties,
+		Created:        created,
+	})
+	if err != nil {
+		log.Warnf("Failed to queue MQTT message for %s: %v", message.topic, err)
+		return
+	}
+	logDebug("Queueing MQTT message for %s", message.topic)
+	mqttQueue.push(content)
+}
+
+// drainMqttQueueInBackground starts draining the queue unless that is already going on
+func drainMqttQueueInBackground() {
+	if mqttQueue == nil || !mqttDraining.CompareAndSwap(false, true) {
+		return
+	}
+	go drainMqttQueue(time.Time{})
+}
+
+// drainMqttQueueBefore drains the queue until the deadline. A drain going on in
+// the background is waited for, and what it left is drained again.
+func drainMqttQueueBefore(deadline time.Time) bool {
+	if mqttQueue == nil {
+		return true
+	}
+	for !mqttDraining.CompareAndSwap(false, true) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return drainMqttQueue(deadline)
+}
+
+// drainMqttQueue publishes the queued messages in their original order. It stops
+// at the first message which could not be delivered, which stays queued, or at
+// the deadline unless that is zero. Messages with an expiry only get the time
+// remaining since they were taken, and are dropped once it has passed.
+// The caller must have set mqttDraining, which is cleared on return.
+func drainMqttQueue(deadline time.Time) bool {
+	if length := mqttQueue.len(); length > 0 {
+		log.Infof("Publishing %d queued MQTT messages", length)
+	}
+	for {
+		mqttQueueLock.Lock()
+		items, seq := mqttQueue.peek(1)
+		if len(items) == 0 {
+			// cleared with the lock held, so a message queued meanwhile starts a new drain
+			mqttDraining.Store(false)
+			mqttQueueLock.Unlock()
+			return true
+		}
+		mqttQueueLock.Unlock()
+		if !mqttClient.IsConnected() || (!deadline.IsZero() && time.Now().After(deadline)) {
+			mqttDraining.Store(false)
+			return false
+		}
+		queued := queuedMqttMessage{}
+		if err := json.Unmarshal(items[0], &queued); err != nil {
+			log.Warnf("Dropping unreadable queued MQTT message: %v", err)
+			mqttQueue.drop(seq)
+			continue
+		}
+		message := mqttMessage{
+			topic:          queued.Topic,
+			payload:        queued.Payload,
+			qos:            queued.QoS,
+			retain:         queued.Retain,
+			contentType:    queued.ContentType,
+			userProperties: queued.UserProperties,
+			created:        queued.Created,
+		}
+		if queued.Expiry > 0 {
+			age := uint32(max(time.Since(queued.Created).Seconds(), 0))
+			if age >= queued.Expiry {
+				logDebug("Dropping expired MQTT message for %s", queued.Topic)
+				mqttQueue.drop(seq)
+				continue
+			}
+			message.expiry = queued.Expiry - age
+		}
+		wait := mqttPublishTimeout + time.Second
+		if !deadline.IsZero() {
+			wait = min(wait, time.Until(deadline))
+		}
+		token := mqttClient.Publish(message)
+		if !token.WaitTimeout(wait) || token.Error() != nil {
+			log.Warnf("Failed to publish queued MQTT message for %s: %v", queued.Topic, token.Error())
+			mqttDraining.Store(false)
+			return false
+		}
+		counterMqttMessages.WithLabelValues(options.MeterName).Inc()
+		mqttQueue.remove(seq)
+	}
+}
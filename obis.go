@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"go.yaml.in/yaml/v2"
+)
+
+var (
+	gaugeObisInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "powermeter",
+		Name:      "obis_info",
+		Help:      "Description of the OBIS ids used as meter_id, always 1",
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+			//obis id as used in the meter_id label of other metrics
+			"meter_id",
+			//full obis code, like 1-0:1.8.0*255
+			"obis",
+			//human readable name of the reading
+			"name",
+			//unit of the reading
+			"unit",
+		})
+)
+
+// obisCode is an OBIS identifier A-B:C.D.E*F as defined in IEC 62056-61.
+type obisCode struct {
+	a, b, c, d, e, f byte
+}
+
+func obisCodeFromBytes(objName []byte) (obisCode, bool) {
+	if len(objName) != 6 {
+		return obisCode{}, false
+	}
+	return obisCode{objName[0], objName[1], objName[2], objName[3], objName[4], objName[5]}, true
+}
+
+var obisPattern = regexp.MustCompile(`^(?:(\d+)-(\d+):)?(\d+)\.(\d+)\.(\d+)(?:\*(\d+))?$`)
+
+// parseObisCode parses the full form A-B:C.D.E*F of an OBIS code. A-B defaults to
+// 1-0 (electricity, channel 0) and F to 255 if omitted.
+func parseObisCode(value string) (obisCode, error) {
+	match := obisPattern.FindStringSubmatch(value)
+	if match == nil {
+		return obisCode{}, fmt.Errorf("Invalid OBIS code %q", value)
+	}
+	defaults := []string{"1", "0", "", "", "", "255"}
+	parts := make([]byte, 6)
+	for i, part := range match[1:] {
+		if len(part) == 0 {
+			part = defaults[i]
+		}
+		number, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return obisCode{}, fmt.Errorf("Invalid OBIS code %q: %v", value, err)
+		}
+		parts[i] = byte(number)
+	}
+	code, _ := obisCodeFromBytes(parts)
+	return code, nil
+}
+
+func (o obisCode) String() string {
+	return fmt.Sprintf("%d-%d:%d.%d.%d*%d", o.a, o.b, o.c, o.d, o.e, o.f)
+}
+
+// shortName returns C.D.E for electricity readings of channel 0, which is what
+// we have always used as meter_id, and the full code for everything else.
+func (o obisCode) shortName() string {
+	if o.a == 1 && o.b == 0 && o.f == 255 {
+		return fmt.Sprintf("%d.%d.%d", o.c, o.d, o.e)
+	}
+	return o.String()
+}
+
+// obisInfo describes the meaning of an OBIS code
+type obisInfo struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	Unit        string `yaml:"unit"`
+	// Type is either counter for cumulative registers or gauge
+	Type string `yaml:"type"`
+	// plausibility rules, in the unit of the reading
+	Min             *float64 `yaml:"min"`
+	Max             *float64 `yaml:"max"`
+	MaxDeltaPerHour *float64 `yaml:"max_delta_per_hour"`
+}
+
+func mustParseObisCode(value string) obisCode {
+	code, err := parseObisCode(value)
+	if err != nil {
+		log.Panicf("Parsing static OBIS code failed: %v", err)
+	}
+	return code
+}
+
+// obisRegistry holds the descriptions of well known OBIS codes, extended by --obisMapping
+var obisRegistry = map[obisCode]obisInfo{
+	mustParseObisCode("1.8.0"):                 {Name: "Grid import", Description: "Positive active energy, total", Unit: "Wh", Type: "counter"},
+	mustParseObisCode("1.8.1"):                 {Name: "Grid import tariff 1", Description: "Positive active energy, tariff 1", Unit: "Wh", Type: "counter"},
+	mustParseObisCode("1.8.2"):                 {Name: "Grid import tariff 2", Description: "Positive active energy, tariff 2", Unit: "Wh", Type: "counter"},
+	mustParseObisCode("2.8.0"):                 {Name: "Grid export", Description: "Negative active energy, total", Unit: "Wh", Type: "counter"},
+	mustParseObisCode("2.8.1"):                 {Name: "Grid export tariff 1", Description: "Negative active energy, tariff 1", Unit: "Wh", Type: "counter"},
+	mustParseObisCode("2.8.2"):                 {Name: "Grid export tariff 2", Description: "Negative active energy, tariff 2", Unit: "Wh", Type: "counter"},
+	mustParseObisCode("16.7.0"):                {Name: "Grid power", Description: "Sum of active instantaneous power", Unit: "W", Type: "gauge"},
+	mustParseObisCode("36.7.0"):                {Name: "Power L1", Description: "Active instantaneous power, phase L1", Unit: "W", Type: "gauge"},
+	mustParseObisCode("56.7.0"):                {Name: "Power L2", Description: "Active instantaneous power, phase L2", Unit: "W", Type: "gauge"},
+	mustParseObisCode("76.7.0"):                {Name: "Power L3", Description: "Active instantaneous power, phase L3", Unit: "W", Type: "gauge"},
+	mustParseObisCode("32.7.0"):                {Name: "Voltage L1", Description: "Instantaneous voltage, phase L1", Unit: "V", Type: "gauge"},
+	mustParseObisCode("52.7.0"):                {Name: "Voltage L2", Description: "Instantaneous voltage, phase L2", Unit: "V", Type: "gauge"},
+	mustParseObisCode("72.7.0"):                {Name: "Voltage L3", Description: "Instantaneous voltage, phase L3", Unit: "V", Type: "gauge"},
+	mustParseObisCode("31.7.0"):                {Name: "Current L1", Description: "Instantaneous current, phase L1", Unit: "A", Type: "gauge"},
+	mustParseObisCode("51.7.0"):                {Name: "Current L2", Description: "Instantaneous current, phase L2", Unit: "A", Type: "gauge"},
+	mustParseObisCode("71.7.0"):                {Name: "Current L3", Description: "Instantaneous current, phase L3", Unit: "A", Type: "gauge"},
+	mustParseObisCode("14.7.0"):                {Name: "Frequency", Description: "Supply frequency", Unit: "Hz", Type: "gauge"},
+	mustParseObisCode("0.0.9"):                 {Name: "Server ID", Description: "Device identification of the meter"},
+	mustParseObisCode("0.2.0"):                 {Name: "Firmware", Description: "Firmware version of the meter"},
+	mustParseObisCode("129-129:199.130.3*255"): {Name: "Manufacturer", Description: "Manufacturer identification"},
+	mustParseObisCode("129-129:199.130.5*255"): {Name: "Public key", Description: "Public key of the meter"},
+}
+
+// loadObisMapping extends the registry with the codes in the given YAML file,
+// mapping OBIS codes to name, description, unit and type.
+func loadObisMapping(filename string) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	mapping := make(map[string]obisInfo)
+	if err := yaml.UnmarshalStrict(content, &mapping); err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", filename, err)
+	}
+	for key, info := range mapping {
+		code, err := parseObisCode(key)
+		if err != nil {
+			return err
+		}
+		if info.Type != "" && info.Type != "counter" && info.Type != "gauge" {
+			return fmt.Errorf("Invalid type %q for OBIS code %s, must be counter or gauge", info.Type, key)
+		}
+		logDebug("Registering OBIS code %s as %q", code, info.Name)
+		obisRegistry[code] = info
+	}
+	return nil
+}
+
+// lookupObis returns the description of the code, falling back to the code itself as name.
+func lookupObis(code obisCode) obisInfo {
+	if info, ok := obisRegistry[code]; ok {
+		if len(info.Name) == 0 {
+			info.Name = code.shortName()
+		}
+		return info
+	}
+	return obisInfo{Name: code.shortName(), Type: "gauge"}
+}
+
+func recordObisInfo(reading meterReading) {
+	info := lookupObis(reading.obis)
+	gaugeObisInfo.WithLabelValues(options.MeterName, reading.name, reading.obis.String(), info.Name, info.Unit).Set(1)
+}
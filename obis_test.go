@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseObisCode(t *testing.T) {
+	for input, expected := range map[string]string{
+		"1.8.0":                 "1-0:1.8.0*255",
+		"1-1:1.8.0*255":         "1-1:1.8.0*255",
+		"1-0:16.7.0":            "1-0:16.7.0*255",
+		"129-129:199.130.3*255": "129-129:199.130.3*255",
+	} {
+		code, err := parseObisCode(input)
+		if err != nil {
+			t.Errorf("parseObisCode(%q) failed: %v", input, err)
+			continue
+		}
+		if code.String() != expected {
+			t.Errorf("parseObisCode(%q) returned %s instead of %s", input, code, expected)
+		}
+	}
+	for _, input := range []string{"", "1.8", "1-0:1.8.0*256", "foo"} {
+		if _, err := parseObisCode(input); err == nil {
+			t.Errorf("parseObisCode(%q) did not fail", input)
+		}
+	}
+
+	if name := mustParseObisCode("1-1:1.8.0").shortName(); name != "1-1:1.8.0*255" {
+		t.Errorf("shortName of channel 1 returned %s", name)
+	}
+}
+
+func TestLoadObisMapping(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mapping.yaml")
+	content := "\"1-0:1.8.0*255\":\n  name: Grid consumption\n  unit: Wh\n  type: counter\n"
+	if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	original := obisRegistry[mustParseObisCode("1.8.0")]
+	defer func() { obisRegistry[mustParseObisCode("1.8.0")] = original }()
+
+	if err := loadObisMapping(filename); err != nil {
+		t.Fatalf("loadObisMapping failed: %v", err)
+	}
+	if info := lookupObis(mustParseObisCode("1.8.0")); info.Name != "Grid consumption" {
+		t.Errorf("lookupObis returned %q after loading the mapping", info.Name)
+	}
+	if info := lookupObis(mustParseObisCode("99.99.99")); info.Name != "99.99.99" {
+		t.Errorf("lookupObis returned %q for an unknown code", info.Name)
+	}
+}
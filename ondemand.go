@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// scrapeReadTimeout limits reads on scrape if --readTimeout is 0, as a silent meter
+// would otherwise block the scrape and all following ones waiting for the same read
+const scrapeReadTimeout = 10 * time.Second
+
+var (
+	readGroup    singleflight.Group
+	lastReadLock sync.Mutex
+	lastReadTime time.Time
+)
+
+// scrapeHandler triggers a fresh read before passing the scrape to next, unless
+// the last successful read is younger than --cacheTTL. Concurrent scrapes share one read.
+func scrapeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readOnDemand()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func readOnDemand() {
+	lastReadLock.Lock()
+	fresh := time.Since(lastReadTime) < time.Duration(options.CacheTTL)*time.Second
+	lastReadLock.Unlock()
+	if fresh {
+		logDebug("Serving cached readings")
+		return
+	}
+
+	_, _, _ = readGroup.Do("read", func() (interface{}, error) {
+		if !gatherAndRecover() {
+			// failed reads are not cached, so the next scrape tries again
+			return nil, nil
+		}
+		lastReadLock.Lock()
+		lastReadTime = time.Now()
+		lastReadLock.Unlock()
+		return nil, nil
+	})
+}
+
+// readTimeout is the time to wait for a complete telegram, 0 to wait forever
+func readTimeout() time.Duration {
+	if options.ReadTimeout <= 0 && options.ReadMode == "scrape" {
+		return scrapeReadTimeout
+	}
+	return time.Duration(options.ReadTimeout) * time.Second
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	otelprometheus "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+var (
+	otlpLock     sync.Mutex
+	otlpProvider *sdkmetric.MeterProvider
+	otlpIdentity meterIdentity
+	otlpRestart  = make(chan meterIdentity, 1)
+)
+
+// otlpEnabled reports whether an OpenTelemetry collector is configured, either
+// with --otlpEndpoint or with the standard environment variables
+func otlpEnabled() bool {
+	return len(options.OtlpEndpoint) > 0 || len(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")) > 0 || len(os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT")) > 0
+}
+
+// startOtlpExport pushes everything registered with the default Prometheus
+// registry to an OpenTelemetry collector. The meter identity is attached as
+// resource attributes. As the resource of a running export can't be changed,
+// the export is restarted when the identity becomes known or changes.
+func startOtlpExport(identity meterIdentity) {
+	otlpLock.Lock()
+	defer otlpLock.Unlock()
+	if otlpProvider != nil {
+		if identity == otlpIdentity {
+			return
+		}
+		logDebug("Restarting OTLP export with the identity of the meter")
+		shutdownOtlpProvider()
+	}
+	exporter, err := newOtlpExporter(context.Background())
+	if err != nil {
+		log.Errorf("Failed to set up OTLP export: %v", err)
+		return
+	}
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(time.Duration(options.OtlpInterval)*time.Second),
+		sdkmetric.WithProducer(otelprometheus.NewMetricProducer(otelprometheus.WithGatherer(prometheus.DefaultGatherer))))
+	otlpProvider = sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(otlpResource(identity)),
+		sdkmetric.WithReader(reader))
+	otlpIdentity = identity
+	log.Infof("Exporting metrics via OTLP/%s every %d seconds", options.OtlpProtocol, options.OtlpInterval)
+}
+
+// restartOtlpExport hands a new identity of the meter to runOtlpRestarts and
+// returns without waiting, as shutting down the running export pushes the
+// metrics a last time, which takes until the timeout if the collector is
+// unreachable. Only the latest identity is kept.
+func restartOtlpExport(identity meterIdentity) {
+	select {
+	case <-otlpRestart:
+	default:
+	}
+	otlpRestart <- identity
+}
+
+// runOtlpRestarts restarts the export with each identity handed to restartOtlpExport
+func runOtlpRestarts() {
+	for identity := range otlpRestart {
+		startOtlpExport(identity)
+	}
+}
+
+// stopOtlpExport pushes the metrics a last time and stops the export
+func stopOtlpExport() {
+	otlpLock.Lock()
+	defer otlpLock.Unlock()
+	if otlpProvider != nil {
+		shutdownOtlpProvider()
+	}
+}
+
+// shutdownOtlpProvider flushes and shuts down the running export. The caller must hold otlpLock.
+func shutdownOtlpProvider() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := otlpProvider.Shutdown(ctx); err != nil {
+		log.Warnf("Failed to shut down OTLP export: %v", err)
+	}
+	otlpProvider = nil
+}
+
+func newOtlpExporter(ctx context.Context) (sdkmetric.Exporter, error) {
+	if options.OtlpProtocol == "http" {
+		exporterOptions := []otlpmetrichttp.Option{}
+		if strings.Contains(options.OtlpEndpoint, "://") {
+			exporterOptions = append(exporterOptions, otlpmetrichttp.WithEndpointURL(options.OtlpEndpoint))
+		} else if len(options.OtlpEndpoint) > 0 {
+			exporterOptions = append(exporterOptions, otlpmetrichttp.WithEndpoint(options.OtlpEndpoint))
+		}
+		if options.OtlpInsecure {
+			exporterOptions = append(exporterOptions, otlpmetrichttp.WithInsecure())
+		}
+		if len(options.OtlpHeaders) > 0 {
+			exporterOptions = append(exporterOptions, otlpmetrichttp.WithHeaders(options.OtlpHeaders))
+		}
+		return otlpmetrichttp.New(ctx, exporterOptions...)
+	}
+
+	exporterOptions := []otlpmetricgrpc.Option{}
+	if strings.Contains(options.OtlpEndpoint, "://") {
+		exporterOptions = append(exporterOptions, otlpmetricgrpc.WithEndpointURL(options.OtlpEndpoint))
+	} else if len(options.OtlpEndpoint) > 0 {
+		exporterOptions = append(exporterOptions, otlpmetricgrpc.WithEndpoint(options.OtlpEndpoint))
+	}
+	if options.OtlpInsecure {
+		exporterOptions = append(exporterOptions, otlpmetricgrpc.WithInsecure())
+	}
+	if len(options.OtlpHeaders) > 0 {
+		exporterOptions = append(exporterOptions, otlpmetricgrpc.WithHeaders(options.OtlpHeaders))
+	}
+	return otlpmetricgrpc.New(ctx, exporterOptions...)
+}
+
+// otlpResource describes the exporter and the meter it reads. Attributes given
+// in OTEL_RESOURCE_ATTRIBUTES take precedence.
+func otlpResource(identity meterIdentity) *resource.Resource {
+	attributes := []attribute.KeyValue{
+		attribute.String("service.name", "powermeter_exporter"),
+	}
+	if len(options.MeterName) > 0 {
+		attributes = append(attributes, attribute.String("service.instance.id", options.MeterName), attribute.String("powermeter.meter_name", options.MeterName))
+	}
+	if len(identity.serverID) > 0 {
+		attributes = append(attributes, attribute.String("powermeter.server_id", identity.serverID))
+	}
+	if len(identity.manufacturer) > 0 {
+		attributes = append(attributes, attribute.String("powermeter.manufacturer", identity.manufacturer))
+	}
+	if len(identity.firmware) > 0 {
+		attributes = append(attributes, attribute.String("powermeter.firmware", identity.firmware))
+	}
+	merged, err := resource.Merge(resource.NewSchemaless(attributes...), resource.Environment())
+	if err != nil {
+		log.Warnf("Failed to merge OTLP resource attributes: %v", err)
+		return resource.NewSchemaless(attributes...)
+	}
+	return merged
+}
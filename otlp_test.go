@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestOtlpResource(t *testing.T) {
+	options.MeterName = "test"
+	defer func() { options.MeterName = "" }()
+
+	resource := otlpResource(meterIdentity{serverID: "1ESY1160123456", manufacturer: "ESY"})
+	expected := map[attribute.Key]string{
+		"service.name":            "powermeter_exporter",
+		"service.instance.id":     "test",
+		"powermeter.meter_name":   "test",
+		"powermeter.server_id":    "1ESY1160123456",
+		"powermeter.manufacturer": "ESY",
+	}
+	for key, value := range expected {
+		if actual, ok := resource.Set().Value(key); !ok || actual.AsString() != value {
+			t.Errorf("Resource attribute %s is %q instead of %q", key, actual.AsString(), value)
+		}
+	}
+	if _, ok := resource.Set().Value("powermeter.firmware"); ok {
+		t.Errorf("Resource has a firmware attribute without a known firmware")
+	}
+}
+
+func TestOtlpExportRestart(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+	defer func(endpoint, protocol string, interval int64) {
+		options.OtlpEndpoint, options.OtlpProtocol, options.OtlpInterval = endpoint, protocol, interval
+	}(options.OtlpEndpoint, options.OtlpProtocol, options.OtlpInterval)
+	options.OtlpEndpoint = server.URL
+	options.OtlpProtocol = "http"
+	options.OtlpInterval = 3600
+
+	if !otlpEnabled() {
+		t.Fatal("OTLP export is not enabled with an endpoint")
+	}
+	startOtlpExport(meterIdentity{})
+	started := otlpProvider
+	startOtlpExport(meterIdentity{})
+	if otlpProvider != started {
+		t.Error("OTLP export was restarted without a new identity")
+	}
+	startOtlpExport(meterIdentity{serverID: "1ESY1160123456"})
+	if otlpProvider == started {
+		t.Error("OTLP export was not restarted with the identity of the meter")
+	}
+	stopOtlpExport()
+	if otlpProvider != nil {
+		t.Error("OTLP export is still running after it was stopped")
+	}
+	// both exports push once when they are shut down
+	if requests.Load() != 2 {
+		t.Errorf("Collector received %d instead of 2 pushes", requests.Load())
+	}
+}
+
+func TestOtlpRestartDoesNotWait(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer func(endpoint, protocol string, interval int64) {
+		options.OtlpEndpoint, options.OtlpProtocol, options.OtlpInterval = endpoint, protocol, interval
+	}(options.OtlpEndpoint, options.OtlpProtocol, options.OtlpInterval)
+	options.OtlpEndpoint = server.URL
+	options.OtlpProtocol = "http"
+	options.OtlpInterval = 3600
+
+	startOtlpExport(meterIdentity{})
+	go runOtlpRestarts()
+	identity := meterIdentity{serverID: "1ESY1160123456"}
+	started := time.Now()
+	restartOtlpExport(identity)
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Restart of the OTLP export waited %s for the collector", elapsed)
+	}
+	// the last push of the replaced export completes once the collector answers
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		otlpLock.Lock()
+		restarted := otlpProvider != nil && otlpIdentity == identity
+		otlpLock.Unlock()
+		if restarted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("OTLP export was not restarted with the identity of the meter")
+		}
+	}
+	stopOtlpExport()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// phaseGauges are the metrics for per-phase readings
+type phaseGauges struct {
+	voltage *prometheus.GaugeVec
+	current *prometheus.GaugeVec
+	power   *prometheus.GaugeVec
+}
+
+func newPhaseGauges(factory promauto.Factory) phaseGauges {
+	return phaseGauges{
+		voltage: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "powermeter",
+			Name:      "voltage_volts",
+			Help:      "Instantaneous voltage per phase",
+		},
+			[]string{
+				//manual name of the meter, to distinguish between multiple sensors
+				"meter_name",
+				//phase of the reading, L1, L2 or L3
+				"phase",
+			}),
+		current: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "powermeter",
+			Name:      "current_amperes",
+			Help:      "Instantaneous current per phase",
+		},
+			[]string{
+				//manual name of the meter, to distinguish between multiple sensors
+				"meter_name",
+				//phase of the reading, L1, L2 or L3
+				"phase",
+			}),
+		power: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "powermeter",
+			Name:      "power_watts",
+			Help:      "Instantaneous active power per phase",
+		},
+			[]string{
+				//manual name of the meter, to distinguish between multiple sensors
+				"meter_name",
+				//phase of the reading, L1, L2 or L3
+				"phase",
+			}),
+	}
+}
+
+var phaseMetrics = newPhaseGauges(promauto.With(prometheus.DefaultRegisterer))
+
+// phaseQuantity maps the OBIS value group C of a per-phase reading to its metric and phase
+type phaseQuantity struct {
+	gauge func(phaseGauges) *prometheus.GaugeVec
+	phase string
+}
+
+func voltageGauge(g phaseGauges) *prometheus.GaugeVec { return g.voltage }
+func currentGauge(g phaseGauges) *prometheus.GaugeVec { return g.current }
+func powerGauge(g phaseGauges) *prometheus.GaugeVec   { return g.power }
+
+var phaseQuantities = map[byte]phaseQuantity{
+	31: {gauge: currentGauge, phase: "L1"},
+	51: {gauge: currentGauge, phase: "L2"},
+	71: {gauge: currentGauge, phase: "L3"},
+	32: {gauge: voltageGauge, phase: "L1"},
+	52: {gauge: voltageGauge, phase: "L2"},
+	72: {gauge: voltageGauge, phase: "L3"},
+	36: {gauge: powerGauge, phase: "L1"},
+	56: {gauge: powerGauge, phase: "L2"},
+	76: {gauge: powerGauge, phase: "L3"},
+}
+
+// recordPhaseReading exports instantaneous per-phase readings (OBIS C.7.0)
+// and returns false if the reading is not one of them.
+func recordPhaseReading(gauges phaseGauges, expiry *seriesExpiry, meterName string, reading meterReading) bool {
+	if reading.obis.a != 1 || reading.obis.d != 7 || reading.obis.e != 0 {
+		return false
+	}
+	quantity, ok := phaseQuantities[reading.obis.c]
+	if !ok {
+		return false
+	}
+	quantity.gauge(gauges).WithLabelValues(meterName, quantity.phase).Set(reading.scaledValue())
+	expiry.touch(quantity.gauge(gauges), meterName, quantity.phase)
+	return true
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordPhaseReading(t *testing.T) {
+	// clientId, serverId, listName and actSensorTime unset, followed by a valList with
+	// voltage L1 (32.7.0, 232.6 V) and power L2 (56.7.0, 1234 W) and the trailing signatures
+	smlListResponse, _ := hex.DecodeString("01010101" + "72" +
+		"77070100200700ff0101622352ff630916" + "01" +
+		"77070100380700ff0101621b520063" + "04d2" + "01" +
+		"0101")
+	response, err := parseListResponse(smlListResponse)
+	if err != nil {
+		t.Fatalf("parseListResponse failed: %v", err)
+	}
+	readings := extractMeterReadings(response, time.Now(), &sensorClock{})
+	if len(readings) != 2 {
+		t.Fatalf("extractMeterReadings returned %d instead of 2 readings", len(readings))
+	}
+	for _, reading := range readings {
+		if !recordPhaseReading(phaseMetrics, nil, options.MeterName, reading) {
+			t.Errorf("recordPhaseReading did not recognize %s", reading.name)
+		}
+	}
+	if voltage := testutil.ToFloat64(phaseMetrics.voltage.WithLabelValues(options.MeterName, "L1")); voltage != 232.6 {
+		t.Errorf("voltage L1 is %f instead of 232.6", voltage)
+	}
+	if power := testutil.ToFloat64(phaseMetrics.power.WithLabelValues(options.MeterName, "L2")); power != 1234 {
+		t.Errorf("power L2 is %f instead of 1234", power)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	counterRejectedReadings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "powermeter",
+		Name:      "rejected_readings_total",
+		Help:      "Number of readings dropped by the plausibility checks",
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+			//obis id of the rejected reading
+			"meter_id",
+			//rule which rejected the reading
+			"reason",
+		})
+)
+
+// plausibilityState is the last accepted value of a reading
+type plausibilityState struct {
+	value float64
+	time  time.Time
+	// number of consecutive rejections by the stateful rules
+	rejected int64
+}
+
+type plausibilityEngine struct {
+	mutex sync.Mutex
+	last  map[string]*plausibilityState
+}
+
+func newPlausibilityEngine() *plausibilityEngine {
+	return &plausibilityEngine{last: make(map[string]*plausibilityState)}
+}
+
+var plausibility = newPlausibilityEngine()
+
+// isCounter reports whether the reading is a cumulative register, either as
+// configured in the OBIS registry or by its unit.
+func isCounter(reading meterReading) bool {
+	if info, ok := obisRegistry[reading.obis]; ok && len(info.Type) > 0 {
+		return info.Type == "counter"
+	}
+	return reading.unit == SML_UNIT_WATT_HOUR
+}
+
+// check applies the plausibility rules to the reading. If the reading is
+// accepted, it becomes the reference for the next check. Otherwise the rule
+// that fired is returned.
+func (p *plausibilityEngine) check(reading meterReading) (string, bool) {
+	info := lookupObis(reading.obis)
+	value := reading.scaledValue()
+	counter := isCounter(reading)
+
+	if counter && value >= float64(options.MaxValue) {
+		return "max_value", false
+	}
+	minValue, maxValue := info.Min, info.Max
+	if reading.unit == SML_UNIT_WATT {
+		if minValue == nil {
+			minValue = &options.MinPower
+		}
+		if maxValue == nil {
+			maxValue = &options.MaxPower
+		}
+	}
+	if minValue != nil && value < *minValue {
+		return "below_min", false
+	}
+	if maxValue != nil && value > *maxValue {
+		return "above_max", false
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	last, ok := p.last[reading.name]
+	if !ok || !counter {
+		p.accept(reading)
+		return "", true
+	}
+
+	reason := ""
+	maxDelta := info.MaxDeltaPerHour
+	if maxDelta == nil && reading.unit == SML_UNIT_WATT_HOUR {
+		maxDelta = &options.MaxEnergyDeltaPerHour
+	}
+	// allow for one step of the register's resolution on top of the configured delta
+	resolution := math.Pow10(int(reading.scaler))
+	if value < last.value {
+		reason = "decreasing"
+	} else if maxDelta != nil && value-last.value > *maxDelta*math.Max(reading.time.Sub(last.time).Hours(), 0)+resolution {
+		reason = "max_delta"
+	}
+
+	if len(reason) > 0 {
+		last.rejected++
+		if options.PlausibilityResetAfter <= 0 || last.rejected < options.PlausibilityResetAfter {
+			return reason, false
+		}
+		log.Warnf("Accepting %s value %f after %d consecutive rejections, assuming the meter has been reset or replaced", reading.name, value, last.rejected)
+	}
+	p.accept(reading)
+	return "", true
+}
+
+func (p *plausibilityEngine) accept(reading meterReading) {
+	p.last[reading.name] = &plausibilityState{value: reading.scaledValue(), time: reading.time}
+}
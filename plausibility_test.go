@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlausibilityCheck(t *testing.T) {
+	options.MaxEnergyDeltaPerHour = 50000
+	options.MinPower = -50000
+	options.MaxPower = 50000
+	options.PlausibilityResetAfter = 3
+	defer func(maxValue int64) { options.MaxValue = maxValue }(options.MaxValue)
+	options.MaxValue = 10000000
+
+	engine := newPlausibilityEngine()
+	start := time.Unix(1700000000, 0)
+	energy := func(wh int64, at time.Time) meterReading {
+		return meterReading{name: "1.8.0", obis: mustParseObisCode("1.8.0"), unit: SML_UNIT_WATT_HOUR, raw: wh, value: float64(wh), time: at}
+	}
+	power := func(w int64) meterReading {
+		return meterReading{name: "16.7.0", obis: mustParseObisCode("16.7.0"), unit: SML_UNIT_WATT, raw: w, value: float64(w), time: start}
+	}
+
+	for _, testcase := range []struct {
+		reading meterReading
+		reason  string
+	}{
+		{energy(1000, start), ""},
+		{energy(1100, start.Add(time.Minute)), ""},
+		{energy(900, start.Add(2*time.Minute)), "decreasing"},
+		// beyond --maxValue, regardless of the time passed
+		{energy(50001100, start.Add(3*time.Minute)), "max_value"},
+		// 5 kWh within two minutes exceeds 50 kWh per hour
+		{energy(6100, start.Add(3*time.Minute)), "max_delta"},
+		// 800 Wh within a minute is within it
+		{energy(1900, start.Add(2*time.Minute)), ""},
+		{power(-1500), ""},
+		{power(-60000), "below_min"},
+		{power(60000), "above_max"},
+	} {
+		reason, ok := engine.check(testcase.reading)
+		if ok != (testcase.reason == "") || reason != testcase.reason {
+			t.Errorf("check of %s=%d returned %q instead of %q", testcase.reading.name, testcase.reading.raw, reason, testcase.reason)
+		}
+	}
+
+	// a replaced meter starts over and is accepted after repeated rejections
+	for i := 1; i <= 3; i++ {
+		_, ok := engine.check(energy(10, start.Add(time.Duration(3+i)*time.Minute)))
+		if ok != (i == 3) {
+			t.Errorf("check of reset counter returned %t in attempt %d", ok, i)
+		}
+	}
+}
+
+func TestPlausibilityCheckScaled(t *testing.T) {
+	options.MaxEnergyDeltaPerHour = 50000
+	defer func(maxValue int64) { options.MaxValue = maxValue }(options.MaxValue)
+	options.MaxValue = 10000000
+	engine := newPlausibilityEngine()
+	start := time.Unix(1700000000, 0)
+	energy := func(raw int64, at time.Time) meterReading {
+		return meterReading{name: "1.8.0", obis: mustParseObisCode("1.8.0"), unit: SML_UNIT_WATT_HOUR, raw: raw, scaler: -1, value: float64(raw), time: at}
+	}
+
+	// all rules use the value in Wh, independent of the resolution of the register
+	for _, testcase := range []struct {
+		reading meterReading
+		reason  string
+	}{
+		{energy(13775, start), ""},
+		// 800 Wh within a minute is within 50 kWh per hour, although the raw value increases by 8000
+		{energy(21775, start.Add(time.Minute)), ""},
+		// 99 MWh, but 990 MWh in raw units of 0.1 Wh
+		{energy(99000000, start.Add(2*time.Minute)), "max_delta"},
+		{energy(100000000, start.Add(2*time.Minute)), "max_value"},
+	} {
+		if reason, _ := engine.check(testcase.reading); reason != testcase.reason {
+			t.Errorf("check of %d * 0.1 Wh returned %q instead of %q", testcase.reading.raw, reason, testcase.reason)
+		}
+	}
+}
+
+func TestPlausibilityCheckZero(t *testing.T) {
+	options.MaxEnergyDeltaPerHour = 50000
+	options.PlausibilityResetAfter = 3
+	engine := newPlausibilityEngine()
+	start := time.Unix(1700000000, 0)
+
+	// unused tariff registers and new meters stay at 0, only a drop to 0 is rejected
+	for i, testcase := range []struct {
+		name   string
+		wh     int64
+		reason string
+	}{
+		{"1.8.2", 0, ""},
+		{"1.8.2", 0, ""},
+		{"1.8.2", 5, ""},
+		{"1.8.0", 1377500, ""},
+		{"1.8.0", 0, "decreasing"},
+	} {
+		reading := meterReading{name: testcase.name, obis: mustParseObisCode(testcase.name), unit: SML_UNIT_WATT_HOUR, raw: testcase.wh, time: start.Add(time.Duration(i) * time.Minute)}
+		if reason, _ := engine.check(reading); reason != testcase.reason {
+			t.Errorf("check of %s=%d Wh returned %q instead of %q", testcase.name, testcase.wh, reason, testcase.reason)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"go.yaml.in/yaml/v2"
+)
+
+// probeModule configures how a target of the /probe endpoint is read
+type probeModule struct {
+	Protocol string         `yaml:"protocol"`
+	Serial   serialSettings `yaml:"serial"`
+	Timeout  time.Duration  `yaml:"timeout"`
+}
+
+type probeConfig struct {
+	Modules map[string]probeModule `yaml:"modules"`
+}
+
+var defaultProbeModule = probeModule{Protocol: "sml", Serial: defaultSerialSettings, Timeout: 10 * time.Second}
+
+var probeModules = map[string]probeModule{
+	"default": defaultProbeModule,
+}
+
+// deviceLock is the lock of a single target, with the number of readers holding or waiting for it
+type deviceLock struct {
+	sync.Mutex
+	users int
+}
+
+// deviceLockSet serializes reads of the same target, as a port can only be read
+// once at a time. A lock is only kept while it is in use, so probes of arbitrary
+// targets do not grow the set.
+type deviceLockSet struct {
+	mutex sync.Mutex
+	locks map[string]*deviceLock
+}
+
+// deviceLocks is shared by the probes and the reads of --device
+var deviceLocks = deviceLockSet{locks: make(map[string]*deviceLock)}
+
+// acquire blocks until the target is free and returns its lock
+func (s *deviceLockSet) acquire(target string) *deviceLock {
+	s.mutex.Lock()
+	lock, ok := s.locks[target]
+	if !ok {
+		lock = &deviceLock{}
+		s.locks[target] = lock
+	}
+	lock.users++
+	s.mutex.Unlock()
+	lock.Lock()
+	return lock
+}
+
+// release frees the target and forgets its lock once nobody waits for it anymore
+func (s *deviceLockSet) release(target string, lock *deviceLock) {
+	lock.Unlock()
+	s.mutex.Lock()
+	lock.users--
+	if lock.users == 0 {
+		delete(s.locks, target)
+	}
+	s.mutex.Unlock()
+}
+
+func loadProbeConfig(filename string) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	config := probeConfig{}
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", filename, err)
+	}
+	for name, module := range config.Modules {
+		if len(module.Protocol) == 0 {
+			module.Protocol = defaultProbeModule.Protocol
+		}
+		if module.Protocol != "sml" {
+			return fmt.Errorf("Unsupported protocol %q in module %s", module.Protocol, name)
+		}
+		if module.Serial.BaudRate == 0 {
+			module.Serial.BaudRate = defaultSerialSettings.BaudRate
+		}
+		if module.Serial.DataBits == 0 {
+			module.Serial.DataBits = defaultSerialSettings.DataBits
+		}
+		if module.Serial.StopBits == 0 {
+			module.Serial.StopBits = defaultSerialSettings.StopBits
+		}
+		if len(module.Serial.Parity) == 0 {
+			module.Serial.Parity = defaultSerialSettings.Parity
+		}
+		if _, ok := parityModes[module.Serial.Parity]; !ok {
+			return fmt.Errorf("Invalid parity %q in module %s", module.Serial.Parity, name)
+		}
+		if module.Timeout == 0 {
+			module.Timeout = defaultProbeModule.Timeout
+		}
+		logDebug("Registering probe module %s: %+v", name, module)
+		probeModules[name] = module
+	}
+	return nil
+}
+
+// probeHandler reads a single telegram from the target given in the request
+// and returns its readings, in the style of the blackbox_exporter.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	target := params.Get("target")
+	if len(target) == 0 {
+		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	moduleName := params.Get("module")
+	if len(moduleName) == 0 {
+		moduleName = "default"
+	}
+	module, ok := probeModules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+	if protocol := params.Get("protocol"); len(protocol) > 0 && protocol != module.Protocol {
+		http.Error(w, fmt.Sprintf("Unsupported protocol %q", protocol), http.StatusBadRequest)
+		return
+	}
+	if target == options.Device && options.KeepAlive {
+		http.Error(w, fmt.Sprintf("Target %s is kept open by the exporter", target), http.StatusConflict)
+		return
+	}
+	meterName := params.Get("meter_name")
+	if len(meterName) == 0 {
+		meterName = target
+	}
+
+	registry := prometheus.NewRegistry()
+	factory := promauto.With(registry)
+	probeSuccess := factory.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Whether the probe read a telegram successfully",
+	})
+	probeDuration := factory.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "Duration of the probe",
+	})
+
+	lock := deviceLocks.acquire(target)
+	start := time.Now()
+	err := probeTarget(target, module, meterName, factory, registry)
+	probeDuration.Set(time.Since(start).Seconds())
+	deviceLocks.release(target, lock)
+
+	if err != nil {
+		log.Warnf("Probe of %s failed: %v", target, err)
+	} else {
+		probeSuccess.Set(1)
+	}
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+func probeTarget(target string, module probeModule, meterName string, factory promauto.Factory, registry *prometheus.Registry) error {
+	port, err := openTarget(target, module)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	message, err := readMessageWithTimeout(port, module.Timeout)
+	if err != nil {
+		return err
+	}
+	response, err := decodeTelegram(message)
+	if err != nil {
+		return err
+	}
+
+	setMeterInfo(newMeterInfoGauge(factory), meterName, extractMeterIdentity(response))
+	if _, seconds, ok := response.actSensorTime.smlTime(); ok {
+		newSensorTimeGauge(factory).WithLabelValues(meterName).Set(float64(seconds))
+	}
+
+	reading := newReadingGauge(factory)
+	statusFlags := newStatusFlagGauge(factory)
+	phases := newPhaseGauges(factory)
+	energy := newEnergyCollector()
+	registry.MustRegister(energy)
+	// a probe reads a single telegram, so it has its own clock and only the
+	// rules which need no previous reading apply
+	clock := sensorClock{}
+	checks := newPlausibilityEngine()
+	for _, meterReading := range extractMeterReadings(response, time.Now(), &clock) {
+		if reason, ok := checks.check(meterReading); !ok {
+			logDebug("Rejected value %f for obis %s of %s because of rule %s", meterReading.value, meterReading.name, target, reason)
+			continue
+		}
+		reading.WithLabelValues(meterName, meterReading.name).Set(meterReading.value)
+		if meterReading.hasStatus {
+			recordStatusFlags(statusFlags, nil, meterName, meterReading)
+		}
+		energy.record(meterName, meterReading)
+		recordPhaseReading(phases, nil, meterName, meterReading)
+	}
+	return nil
+}
+
+// openTarget connects to a serial device or to a TCP IR bridge given as tcp://host:port
+func openTarget(target string, module probeModule) (io.ReadWriteCloser, error) {
+	if address, ok := strings.CutPrefix(target, "tcp://"); ok {
+		return net.DialTimeout("tcp", address, module.Timeout)
+	}
+	return openSerial(target, module.Serial)
+}
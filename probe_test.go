@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeTcpTarget(t *testing.T) {
+	content, err := os.ReadFile("testdata/smlfile-1")
+	if err != nil {
+		t.Fatalf("could not open testdata: %v", err)
+	}
+	data, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(string(content)), "\n", ""))
+	if err != nil {
+		t.Fatalf("could not decode hex: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write(data)
+	}()
+
+	clock, sensorTime := meterClock, lastSensorTime
+	recorder := httptest.NewRecorder()
+	probeHandler(recorder, httptest.NewRequest("GET", "/probe?target=tcp://"+listener.Addr().String()+"&meter_name=bridge", nil))
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"probe_success 1",
+		`powermeter_reading{meter_id="1.8.0",meter_name="bridge"} 13775`,
+		`powermeter_meter_info{firmware="",manufacturer="ISK",meter_name="bridge",server_id="090149534b00050cd2eb"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("probe result does not contain %s:\n%s", expected, body)
+		}
+	}
+	if meterClock != clock || lastSensorTime != sensorTime {
+		t.Error("probe changed the clock of the local meter")
+	}
+	if len(deviceLocks.locks) != 0 {
+		t.Errorf("probe kept %d device locks", len(deviceLocks.locks))
+	}
+}
+
+func TestDeviceLockSet(t *testing.T) {
+	locks := deviceLockSet{locks: make(map[string]*deviceLock)}
+	first := locks.acquire("/dev/ttyUSB0")
+	acquired := make(chan *deviceLock)
+	go func() {
+		acquired <- locks.acquire("/dev/ttyUSB0")
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second reader acquired a locked device")
+	case <-time.After(50 * time.Millisecond):
+	}
+	locks.release("/dev/ttyUSB0", first)
+	second := <-acquired
+	if second != first {
+		t.Error("second reader got a different lock for the same device")
+	}
+	locks.release("/dev/ttyUSB0", second)
+	if len(locks.locks) != 0 {
+		t.Errorf("lock set kept %d unused locks", len(locks.locks))
+	}
+}
+
+func TestProbeInvalidRequest(t *testing.T) {
+	for _, query := range []string{"", "?target=/dev/null&module=unknown", "?target=/dev/null&protocol=dsmr"} {
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, httptest.NewRequest("GET", "/probe"+query, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("probe with %q returned status %d", query, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteBatchSize is the maximum number of samples sent in one request
+const remoteWriteBatchSize = 500
+
+// remoteWriter pushes readings to a Prometheus remote_write endpoint. Every
+// reading is queued as an encoded TimeSeries and sent with its own timestamp,
+// so readings taken while the endpoint is unreachable are delivered later.
+type remoteWriter struct {
+	url         string
+	username    string
+	password    string
+	bearerToken string
+	client      *http.Client
+	queue       *spoolQueue
+}
+
+var remoteWrite *remoteWriter
+
+func newRemoteWriter(url string, queueDir string, queueSize int) (*remoteWriter, error) {
+	queue, err := newSpoolQueue("remote_write", queueDir, queueSize)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteWriter{
+		url:         url,
+		username:    options.RemoteWriteUser,
+		password:    options.RemoteWritePassword,
+		bearerToken: options.RemoteWriteBearerToken,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		queue:       queue,
+	}, nil
+}
+
+// enqueue queues a reading to be sent with the next flush
+func (w *remoteWriter) enqueue(meterName string, reading meterReading) {
+	labels := map[string]string{
+		"__name__":   "powermeter_reading",
+		"meter_name": meterName,
+		"meter_id":   reading.name,
+	}
+	w.queue.push(encodeTimeSeries(labels, reading.value, reading.time))
+}
+
+// run flushes the queue every interval until the process ends
+func (w *remoteWriter) run(interval time.Duration) {
+	flushPeriodically(w.queue, interval, w.flush)
+}
+
+// flush sends the oldest batch of queued samples. Samples are kept for a retry
+// if the endpoint is unreachable, see classifyWriteResponse for its answers.
+func (w *remoteWriter) flush() error {
+	batch, last := w.queue.peek(remoteWriteBatchSize)
+	if len(batch) == 0 {
+		return nil
+	}
+	request, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(snappy.Encode(nil, encodeWriteRequest(batch))))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	request.Header.Set("User-Agent", "powermeter_exporter")
+	if len(w.bearerToken) > 0 {
+		request.Header.Set("Authorization", "Bearer "+w.bearerToken)
+	} else if len(w.username) > 0 {
+		request.SetBasicAuth(w.username, w.password)
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+
+	drop, err := classifyWriteResponse(response, body)
+	switch {
+	case err != nil:
+		return err
+	case drop:
+		log.Warnf("Remote write endpoint rejected %d samples with %s: %s", len(batch), response.Status, bytes.TrimSpace(body))
+		w.queue.drop(last)
+	default:
+		logDebug("Remote write of %d samples succeeded", len(batch))
+		w.queue.remove(last)
+	}
+	return nil
+}
+
+// encodeTimeSeries encodes a prometheus.TimeSeries message with a single sample.
+// Labels are sorted by name, as required by the remote write specification.
+func encodeTimeSeries(labels map[string]string, value float64, timestamp time.Time) []byte {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var series []byte
+	for _, name := range names {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, labels[name])
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestamp.UnixMilli()))
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+	return series
+}
+
+// encodeWriteRequest wraps encoded TimeSeries messages into a prometheus.WriteRequest
+func encodeWriteRequest(series [][]byte) []byte {
+	var request []byte
+	for _, s := range series {
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, s)
+	}
+	return request
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeFields returns the raw values of all fields of a protobuf message by field number
+func decodeFields(t *testing.T, message []byte) map[protowire.Number][][]byte {
+	fields := make(map[protowire.Number][][]byte)
+	for len(message) > 0 {
+		number, wireType, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			t.Fatalf("Invalid tag: %v", protowire.ParseError(n))
+		}
+		message = message[n:]
+		n = protowire.ConsumeFieldValue(number, wireType, message)
+		if n < 0 {
+			t.Fatalf("Invalid field %d: %v", number, protowire.ParseError(n))
+		}
+		value := message[:n]
+		if wireType == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+		fields[number] = append(fields[number], value)
+		message = message[n:]
+	}
+	return fields
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var received []byte
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received, _ = snappy.Decode(nil, body)
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	writer, err := newRemoteWriter(server.URL, "", 10)
+	if err != nil {
+		t.Fatalf("newRemoteWriter failed: %v", err)
+	}
+	writer.bearerToken = "secret"
+	readingTime := time.UnixMilli(1700000000123)
+	writer.enqueue("test", meterReading{name: "1.8.0", value: 1234.5, time: readingTime})
+	if err := writer.flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if writer.queue.len() != 0 {
+		t.Errorf("Queue still holds %d samples after a successful flush", writer.queue.len())
+	}
+	if authorization != "Bearer secret" {
+		t.Errorf("Authorization header is %q", authorization)
+	}
+
+	series := decodeFields(t, received)[1]
+	if len(series) != 1 {
+		t.Fatalf("Expected 1 time series, got %d", len(series))
+	}
+	fields := decodeFields(t, series[0])
+	expectedLabels := [][2]string{{"__name__", "powermeter_reading"}, {"meter_id", "1.8.0"}, {"meter_name", "test"}}
+	if len(fields[1]) != len(expectedLabels) {
+		t.Fatalf("Expected %d labels, got %d", len(expectedLabels), len(fields[1]))
+	}
+	for i, label := range fields[1] {
+		labelFields := decodeFields(t, label)
+		if name, value := string(labelFields[1][0]), string(labelFields[2][0]); name != expectedLabels[i][0] || value != expectedLabels[i][1] {
+			t.Errorf("Label %d is %s=%s instead of %s=%s", i, name, value, expectedLabels[i][0], expectedLabels[i][1])
+		}
+	}
+	sample := decodeFields(t, fields[2][0])
+	value, _ := protowire.ConsumeFixed64(sample[1][0])
+	timestamp, _ := protowire.ConsumeVarint(sample[2][0])
+	if math.Float64frombits(value) != 1234.5 || int64(timestamp) != readingTime.UnixMilli() {
+		t.Errorf("Sample is %f@%d instead of 1234.5@%d", math.Float64frombits(value), timestamp, readingTime.UnixMilli())
+	}
+}
+
+func TestRemoteWriteRetry(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	writer, err := newRemoteWriter(server.URL, "", 10)
+	if err != nil {
+		t.Fatalf("newRemoteWriter failed: %v", err)
+	}
+	writer.enqueue("test", meterReading{name: "1.8.0", value: 1, time: time.Now()})
+	if err := writer.flush(); err == nil {
+		t.Errorf("flush did not fail for a server error")
+	}
+	if writer.queue.len() != 1 {
+		t.Errorf("Sample was not kept for a retry")
+	}
+
+	status = http.StatusUnauthorized
+	if err := writer.flush(); err == nil {
+		t.Errorf("flush did not fail for refused credentials")
+	}
+	if writer.queue.len() != 1 {
+		t.Errorf("Sample was not kept while the credentials are refused")
+	}
+
+	status = http.StatusBadRequest
+	if err := writer.flush(); err != nil {
+		t.Errorf("flush failed for a rejected sample: %v", err)
+	}
+	if writer.queue.len() != 0 {
+		t.Errorf("Rejected sample was not dropped")
+	}
+}
+
+func TestSpoolQueuePersistence(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := newSpoolQueue("test", dir, 2)
+	if err != nil {
+		t.Fatalf("newSpoolQueue failed: %v", err)
+	}
+	queue.push([]byte("a"))
+	queue.push([]byte("b"))
+	queue.push([]byte("c"))
+	_, last := queue.peek(1)
+	queue.remove(last)
+
+	restored, err := newSpoolQueue("test", dir, 2)
+	if err != nil {
+		t.Fatalf("newSpoolQueue failed: %v", err)
+	}
+	items, _ := restored.peek(10)
+	if len(items) != 1 || string(items[0]) != "c" {
+		t.Errorf("Restored queue holds %q instead of [c]", items)
+	}
+	restored.push([]byte("d"))
+	if items, _ := restored.peek(10); len(items) != 2 || string(items[1]) != "d" {
+		t.Errorf("Queue holds %q instead of [c d]", items)
+	}
+}
+
+func TestSpoolQueueRemovePeeked(t *testing.T) {
+	queue, err := newSpoolQueue("test", "", 2)
+	if err != nil {
+		t.Fatalf("newSpoolQueue failed: %v", err)
+	}
+	queue.push([]byte("a"))
+	queue.push([]byte("b"))
+	_, last := queue.peek(2)
+	// pushed while a and b are being sent, which drops a
+	queue.push([]byte("c"))
+	queue.remove(last)
+	if items, _ := queue.peek(10); len(items) != 1 || string(items[0]) != "c" {
+		t.Errorf("Queue holds %q instead of [c]", items)
+	}
+}
+
+func TestSpoolQueueSharedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	first, err := newSpoolQueue("first", dir, 10)
+	if err != nil {
+		t.Fatalf("newSpoolQueue failed: %v", err)
+	}
+	second, err := newSpoolQueue("second", dir, 10)
+	if err != nil {
+		t.Fatalf("newSpoolQueue failed: %v", err)
+	}
+	first.push([]byte("a"))
+	second.push([]byte("b"))
+
+	restored, err := newSpoolQueue("first", dir, 10)
+	if err != nil {
+		t.Fatalf("newSpoolQueue failed: %v", err)
+	}
+	if items, _ := restored.peek(10); len(items) != 1 || string(items[0]) != "a" {
+		t.Errorf("Restored queue holds %q instead of [a]", items)
+	}
+}
+
+func TestFlushRemaining(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	writer, err := newRemoteWriter(server.URL, "", 10)
+	if err != nil {
+		t.Fatalf("newRemoteWriter failed: %v", err)
+	}
+	writer.enqueue("test", meterReading{name: "1.8.0", value: 1, time: time.Now()})
+	flushRemaining(writer.queue, writer.flush, time.Now().Add(time.Minute))
+	if requests != 1 || writer.queue.len() != 1 {
+		t.Errorf("Failing flush was tried %d times and left %d samples", requests, writer.queue.len())
+	}
+
+	status = http.StatusNoContent
+	flushRemaining(writer.queue, writer.flush, time.Now().Add(time.Minute))
+	if writer.queue.len() != 0 {
+		t.Errorf("Flush left %d samples", writer.queue.len())
+	}
+	writer.enqueue("test", meterReading{name: "1.8.0", value: 2, time: time.Now()})
+	flushRemaining(writer.queue, writer.flush, time.Now())
+	if requests != 2 || writer.queue.len() != 1 {
+		t.Errorf("Flush after the deadline sent %d requests and left %d samples", requests, writer.queue.len())
+	}
+}
+
+func TestFlushRemainingWithoutProgress(t *testing.T) {
+	queue, err := newSpoolQueue("test", "", 10)
+	if err != nil {
+		t.Fatalf("newSpoolQueue failed: %v", err)
+	}
+	queue.push([]byte("a"))
+	flushes := 0
+	// a flush which sends nothing must not be repeated until the deadline
+	flushRemaining(queue, func() error { flushes++; return nil }, time.Now().Add(time.Second))
+	if flushes != 1 {
+		t.Errorf("Flush without progress was called %d times", flushes)
+	}
+}
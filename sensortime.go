@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var gaugeSensorTime = newSensorTimeGauge(promauto.With(prometheus.DefaultRegisterer))
+
+func newSensorTimeGauge(factory promauto.Factory) *prometheus.GaugeVec {
+	return factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "powermeter",
+		Name:      "sensor_time_seconds",
+		Help:      "Time reported by the meter in its telegrams, seconds since installation (secIndex) or since the epoch",
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+		})
+}
+
+// sensorTime is a time as reported by the meter
+type sensorTime struct {
+	timeType uint64
+	seconds  uint64
+}
+
+// lastSensorTime is the actSensorTime of the last telegram, to detect duplicates
+var lastSensorTime sensorTime
+
+// telegramClock remembers the last accepted telegram, to observe the interval between telegrams
+type telegramClock struct {
+	time          time.Time
+	sensorSeconds *uint64
+}
+
+var lastTelegram telegramClock
+
+// advance records the telegram and returns the seconds since the previous one.
+// If both telegrams carry the meter's clock, the interval is taken from it, which
+// is not distorted by buffered serial reads. Otherwise the wall clock is used.
+func (c *telegramClock) advance(telegramTime time.Time, sensorSeconds *uint64) (float64, bool) {
+	previous := *c
+	c.time, c.sensorSeconds = telegramTime, sensorSeconds
+	if previous.time.IsZero() {
+		return 0, false
+	}
+	if previous.sensorSeconds != nil && sensorSeconds != nil {
+		if *sensorSeconds <= *previous.sensorSeconds {
+			// the meter has been reset or replaced
+			return 0, false
+		}
+		return float64(*sensorSeconds - *previous.sensorSeconds), true
+	}
+	if !telegramTime.After(previous.time) {
+		return 0, false
+	}
+	return telegramTime.Sub(previous.time).Seconds(), true
+}
+
+// sensorClock maps the secIndex of a meter to wall clock time. It is anchored
+// to the wall clock once and then follows the meter's clock, which removes the
+// jitter introduced by buffered serial reads.
+type sensorClock struct {
+	anchor time.Time
+	valid  bool
+}
+
+// meterClock is the clock of the local meter. Probed meters get their own clock.
+var meterClock sensorClock
+
+// timestamp returns the wall clock time of the given sensor time.
+func (c *sensorClock) timestamp(timeType uint64, seconds uint64, now time.Time) time.Time {
+	if timeType == SML_TIME_TIMESTAMP {
+		return time.Unix(int64(seconds), 0)
+	}
+
+	maxDrift := time.Duration(options.SensorTimeMaxDrift) * time.Second
+	result := c.anchor.Add(time.Duration(seconds) * time.Second)
+	if !c.valid || result.Sub(now) > maxDrift || now.Sub(result) > maxDrift {
+		if c.valid {
+			log.Infof("Sensor time %d drifted from wall clock by %s, re-anchoring", seconds, result.Sub(now))
+		}
+		c.anchor = now.Add(-time.Duration(seconds) * time.Second)
+		c.valid = true
+		result = now
+	}
+	return result
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -19,20 +20,48 @@ var SML_ESCAPE = "1b1b1b1b"
 var SML_FILE_START = "01010101"
 var SML_FILE_END = "1a"
 var SML_LIST_RESPONSE_PREFIX = "7263070177"
+var SML_OBIS_MANUFACTURER = "8181c78203ff"
+var SML_OBIS_SERVER_ID = "0100000009ff"
+var SML_OBIS_FIRMWARE = "0100000200ff"
+
+// used to scan for energy registers in telegrams which cannot be decoded structurally
 var SML_OBIS_PREFIX = "77070100"
-var SML_UNIT_WATT_HOUR = "621e"
+var SML_UNIT_WATT_HOUR_ELEMENT = "621e"
 
 func readMessage(port io.ReadWriteCloser) ([]byte, error) {
-	return readUntil(port, mustDecodeStringToHex(SML_ESCAPE+SML_FILE_START), mustDecodeStringToHex(SML_ESCAPE+SML_FILE_END))
+	trailerLength := 0
+	if options.VerifyChecksum {
+		// number of fill bytes and the CRC
+		trailerLength = 3
+	}
+	message, err := readUntil(port, mustDecodeStringToHex(SML_ESCAPE+SML_FILE_START), mustDecodeStringToHex(SML_ESCAPE+SML_FILE_END), trailerLength)
+	if err != nil {
+		return nil, err
+	}
+	if options.VerifyChecksum {
+		if err := verifyChecksum(message); err != nil {
+			return nil, err
+		}
+	}
+	return message, nil
 }
 
-func readUntil(port io.ReadWriteCloser, startSequence []byte, stopSequence []byte) ([]byte, error) {
+var errFraming = errors.New("No complete message")
+
+// maxMessageSize limits the bytes read in search of a message, so a port sending
+// garbage, e.g. because of a wrong baud rate, fails instead of filling the memory
+const maxMessageSize = 16384
+
+func readUntil(port io.ReadWriteCloser, startSequence []byte, stopSequence []byte, trailerLength int) ([]byte, error) {
 	buffer := make([]byte, 250)
 	preamble := make([]byte, 0, 1024)
 	result := make([]byte, 0, 1024)
 
 	// First scan for start delimiter
 	for !bytes.Contains(preamble, startSequence) {
+		if len(preamble) > maxMessageSize {
+			return nil, fmt.Errorf("%w: no start sequence within %d bytes", errFraming, len(preamble))
+		}
 		c, err := port.Read(buffer)
 		if err != nil {
 			log.Printf("Read error searching for startSequence: %v", err)
@@ -50,6 +79,9 @@ func readUntil(port io.ReadWriteCloser, startSequence []byte, stopSequence []byt
 
 	// Scan for stop sequence, keep all in between
 	for !bytes.Contains(result, stopSequence) {
+		if len(result) > maxMessageSize {
+			return nil, fmt.Errorf("%w: no stop sequence within %d bytes", errFraming, len(result))
+		}
 		c, err := port.Read(buffer)
 		if err != nil {
 			log.Printf("Read error searching for stopSequence: %v", err)
@@ -57,20 +89,60 @@ func readUntil(port io.ReadWriteCloser, startSequence []byte, stopSequence []byt
 		}
 		logDebug("Read %d additional bytes in search for stopSequence", c)
 		logDebug("%s", hex.EncodeToString(buffer[:c]))
-
-		if bytes.Contains(buffer[:c], stopSequence) {
-			idx := bytes.Index(buffer[:c], stopSequence)
-			result = append(result, buffer[:idx+len(stopSequence)]...)
-			log.Printf("Last read contained stopSequence at %d, skipping %d bytes, returning result with %d bytes", idx, c-idx, len(result))
-			return result, nil
-		}
 		result = append(result, buffer[:c]...)
 		logDebug("appended result is now %d bytes", len(result))
 	}
 
 	finalStopIdx := bytes.Index(result, stopSequence)
+	messageLength := finalStopIdx + len(stopSequence) + trailerLength
 	logDebug("Stop sequence found in result at idx %d, finalizing message", finalStopIdx)
-	return result[:finalStopIdx+len(stopSequence)], nil
+
+	// Read the trailer following the stop sequence, if it is not complete yet
+	for len(result) < messageLength {
+		c, err := port.Read(buffer)
+		if err != nil {
+			log.Printf("Read error reading trailer: %v", err)
+			return nil, err
+		}
+		result = append(result, buffer[:c]...)
+	}
+	if len(result) > messageLength {
+		log.Printf("Skipping %d bytes after the end of the message, returning result with %d bytes", len(result)-messageLength, messageLength)
+	}
+	return result[:messageLength], nil
+}
+
+var errChecksum = errors.New("Checksum mismatch")
+
+// verifyChecksum checks the CRC at the end of an SML file, which covers all
+// bytes from the start sequence up to the number of fill bytes.
+func verifyChecksum(smlFile []byte) error {
+	if len(smlFile) < 2 {
+		return errChecksum
+	}
+	expected := crc16X25(smlFile[:len(smlFile)-2])
+	received := uint16(smlFile[len(smlFile)-2])<<8 | uint16(smlFile[len(smlFile)-1])
+	// some meters send the checksum in little endian byte order
+	if received != expected && received != expected>>8|expected<<8 {
+		return fmt.Errorf("%w: calculated %04x, received %04x", errChecksum, expected, received)
+	}
+	return nil
+}
+
+// crc16X25 calculates the CRC-16/X-25 used by SML
+func crc16X25(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
 }
 
 func extractListResponse(smlFile []byte) ([]byte, error) {
@@ -83,44 +155,274 @@ func extractListResponse(smlFile []byte) ([]byte, error) {
 	return dataSplice[1], nil
 }
 
-func extractMeterReadings(smlListResponse []byte) []meterReading {
+// decodeTelegram extracts and decodes the GetListResponse of an SML file
+func decodeTelegram(smlFile []byte) (smlGetListResponse, error) {
+	smlListResponse, err := extractListResponse(smlFile)
+	if err != nil {
+		return smlGetListResponse{}, err
+	}
+	return parseListResponse(smlListResponse)
+}
+
+var errReadTimeout = errors.New("Timeout reading message")
+
+// readMessageWithTimeout reads a message like readMessage, but gives up after
+// the timeout. The caller has to close the port on timeout to abort the pending read.
+func readMessageWithTimeout(port io.ReadWriteCloser, timeout time.Duration) ([]byte, error) {
+	type readResult struct {
+		message []byte
+		err     error
+	}
+	result := make(chan readResult, 1)
+	go func() {
+		message, err := readMessage(port)
+		result <- readResult{message: message, err: err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.message, r.err
+	case <-time.After(timeout):
+		return nil, errReadTimeout
+	}
+}
+
+// smlElement is a single decoded element of an SML message, see the TL-field
+// description in the SML spec (BSI TR-03109-1, 6.3.1).
+type smlElement struct {
+	kind     byte
+	value    []byte
+	children []smlElement
+}
+
+var SML_TYPE_OCTET_STRING byte = 0x00
+var SML_TYPE_BOOLEAN byte = 0x40
+var SML_TYPE_INTEGER byte = 0x50
+var SML_TYPE_UNSIGNED byte = 0x60
+var SML_TYPE_LIST byte = 0x70
+
+// units as defined in DLMS/COSEM (IEC 62056-62)
+var SML_UNIT_WATT byte = 27
+var SML_UNIT_WATT_HOUR byte = 30
+var SML_UNIT_AMPERE byte = 33
+var SML_UNIT_VOLT byte = 35
+
+// supportedUnits are the units of readings we export
+var supportedUnits = map[byte]bool{
+	SML_UNIT_WATT:      true,
+	SML_UNIT_WATT_HOUR: true,
+	SML_UNIT_AMPERE:    true,
+	SML_UNIT_VOLT:      true,
+}
+
+// unitSymbols are the symbols of the supported units, as used in OBIS descriptions
+var unitSymbols = map[byte]string{
+	SML_UNIT_WATT:      "W",
+	SML_UNIT_WATT_HOUR: "Wh",
+	SML_UNIT_AMPERE:    "A",
+	SML_UNIT_VOLT:      "V",
+}
+
+// parseSmlElement decodes the element at the start of data and returns it
+// together with the number of bytes consumed.
+func parseSmlElement(data []byte) (smlElement, int, error) {
+	if len(data) == 0 {
+		return smlElement{}, 0, errors.New("Unexpected end of data")
+	}
+	kind := data[0] & 0x70
+	length := int(data[0] & 0x0f)
+	tlSize := 1
+	for data[tlSize-1]&0x80 != 0 {
+		if tlSize >= len(data) {
+			return smlElement{}, 0, errors.New("Unexpected end of data in TL field")
+		}
+		length = length<<4 | int(data[tlSize]&0x0f)
+		tlSize++
+	}
+
+	if kind == SML_TYPE_LIST {
+		element := smlElement{kind: kind, children: make([]smlElement, 0, length)}
+		consumed := tlSize
+		for i := 0; i < length; i++ {
+			child, n, err := parseSmlElement(data[consumed:])
+			if err != nil {
+				return smlElement{}, 0, err
+			}
+			element.children = append(element.children, child)
+			consumed += n
+		}
+		return element, consumed, nil
+	}
+
+	// for all other types the length includes the TL field itself
+	if length < tlSize || length > len(data) {
+		return smlElement{}, 0, fmt.Errorf("Invalid element length %d at TL %x", length, data[0])
+	}
+	return smlElement{kind: kind, value: data[tlSize:length]}, length, nil
+}
+
+// isEmpty reports whether the element is an optional value which is not set.
+func (e smlElement) isEmpty() bool {
+	return e.kind == SML_TYPE_OCTET_STRING && len(e.value) == 0
+}
+
+func (e smlElement) int64() int64 {
+	if e.kind == SML_TYPE_INTEGER && len(e.value) > 0 && len(e.value) < 8 && e.value[0]&0x80 != 0 {
+		// sign extend negative values shorter than 8 bytes
+		return decodeBytes(e.value) - 1<<(8*len(e.value))
+	}
+	return decodeBytes(e.value)
+}
+
+var SML_TIME_SEC_INDEX uint64 = 1
+var SML_TIME_TIMESTAMP uint64 = 2
+var SML_TIME_LOCAL_TIMESTAMP uint64 = 3
+
+// smlTime decodes an SML_Time element into its type (secIndex or timestamp)
+// and seconds. It returns false if the element is not set or not a valid time.
+func (e smlElement) smlTime() (uint64, uint64, bool) {
+	if e.kind != SML_TYPE_LIST || len(e.children) != 2 {
+		return 0, 0, false
+	}
+	timeType := uint64(e.children[0].int64())
+	switch timeType {
+	case SML_TIME_SEC_INDEX, SML_TIME_TIMESTAMP:
+		return timeType, uint64(e.children[1].int64()), true
+	case SML_TIME_LOCAL_TIMESTAMP:
+		// list of timestamp, localOffset and seasonTimeOffset, we only need the UTC timestamp
+		if len(e.children[1].children) < 1 {
+			return 0, 0, false
+		}
+		return SML_TIME_TIMESTAMP, uint64(e.children[1].children[0].int64()), true
+	}
+	return 0, 0, false
+}
+
+// smlListEntry is a single entry of the valList of a GetListResponse.
+type smlListEntry struct {
+	objName []byte
+	status  smlElement
+	valTime smlElement
+	unit    byte
+	scaler  int8
+	value   smlElement
+}
+
+// smlGetListResponse holds the decoded parts of a GetListResponse we are interested in.
+type smlGetListResponse struct {
+	serverID      []byte
+	actSensorTime smlElement
+	entries       []smlListEntry
+}
+
+// parseListResponse decodes the GetListResponse body as returned by extractListResponse.
+func parseListResponse(smlListResponse []byte) (smlGetListResponse, error) {
+	result := smlGetListResponse{}
+	// the list prefix has been cut off by extractListResponse, so the 7 elements
+	// clientId, serverId, listName, actSensorTime, valList, listSignature and
+	// actGatewayTime follow directly
+	elements := make([]smlElement, 0, 7)
+	consumed := 0
+	for i := 0; i < 5; i++ {
+		element, n, err := parseSmlElement(smlListResponse[consumed:])
+		if err != nil {
+			return result, fmt.Errorf("Failed to parse list response element %d: %v", i, err)
+		}
+		elements = append(elements, element)
+		consumed += n
+	}
+	result.serverID = elements[1].value
+	result.actSensorTime = elements[3]
+
+	if elements[4].kind != SML_TYPE_LIST {
+		return result, errors.New("Unexpected type for valList")
+	}
+	for _, entry := range elements[4].children {
+		if entry.kind != SML_TYPE_LIST || len(entry.children) != 7 {
+			logDebug("Skipping malformed list entry")
+			continue
+		}
+		result.entries = append(result.entries, smlListEntry{
+			objName: entry.children[0].value,
+			status:  entry.children[1],
+			valTime: entry.children[2],
+			unit:    byte(entry.children[3].int64()),
+			scaler:  int8(entry.children[4].int64()),
+			value:   entry.children[5],
+		})
+	}
+	return result, nil
+}
+
+// meterIdentity describes the hardware of a meter as reported in its telegrams.
+type meterIdentity struct {
+	serverID     string
+	manufacturer string
+	firmware     string
+}
+
+func extractMeterIdentity(response smlGetListResponse) meterIdentity {
+	identity := meterIdentity{serverID: hex.EncodeToString(response.serverID)}
+	for _, entry := range response.entries {
+		switch hex.EncodeToString(entry.objName) {
+		case SML_OBIS_SERVER_ID:
+			identity.serverID = hex.EncodeToString(entry.value.value)
+		case SML_OBIS_MANUFACTURER:
+			identity.manufacturer = string(entry.value.value)
+		case SML_OBIS_FIRMWARE:
+			identity.firmware = formatOctetString(entry.value.value)
+		}
+	}
+	return identity
+}
+
+// formatOctetString returns printable octet strings as text and all others hex encoded.
+func formatOctetString(value []byte) string {
+	for _, b := range value {
+		if b < 0x20 || b > 0x7e {
+			return hex.EncodeToString(value)
+		}
+	}
+	return string(value)
+}
+
+// extractMeterReadings returns all energy, power, voltage and current readings of the response.
+// Readings without an own valTime are timestamped with telegramTime, the others
+// are mapped to wall clock time by the clock of the meter.
+func extractMeterReadings(response smlGetListResponse, telegramTime time.Time, clock *sensorClock) []meterReading {
 	result := make([]meterReading, 0, 5)
-	// split on list start and obis prefix
-	dataSplice := bytes.Split(smlListResponse, mustDecodeStringToHex(SML_OBIS_PREFIX))
-	for _, data := range dataSplice[1:] {
-		logDebug("Decoding obis chunk\n%s", formatHexBytes(data, 32))
-		if len(data) < 12 {
-			log.Printf("Data chunk too small, %d<12", len(data))
+	for _, entry := range response.entries {
+		code, ok := obisCodeFromBytes(entry.objName)
+		if !ok {
+			logDebug("Skipping entry with invalid objName %x", entry.objName)
 			continue
 		}
-		obis := fmt.Sprintf("%d.%d.%d", data[0], data[1], data[2])
-		logDebug("Decoded obis %s", obis)
-		// split on unit defintion (Wh)
-		dataSplice2 := bytes.Split(data, mustDecodeStringToHex(SML_UNIT_WATT_HOUR))
+		obis := code.shortName()
+		logDebug("Decoded obis %s", code)
 
-		if len(dataSplice2) < 2 {
-			logDebug("Skipping obis entry %s without expected unit", obis)
+		if !supportedUnits[entry.unit] {
+			logDebug("Skipping obis entry %s without supported unit", obis)
 			continue
 		}
-		data = dataSplice2[1]
-		logDebug("Decoding 2nd part of message\n%s", formatHexBytes(data, 32))
-		scaler := data[1] & 0x0f // e.g. 5203 // expect 3 for kWh
-		size := data[2] & 0x0f   // e.g. 69xxxxxxxxx
-
-		if size > 0 {
-			logDebug("Decoded size %d", size)
-			logDebug("Decoded scaler %d", scaler)
-			value := float64(decodeBytes(data[3:3+size-1])) / float64(options.Factor)
-			logDebug("Decoded value %f", value)
-			if value < float64(options.MaxValue) && value > 0 {
-				newReading := meterReading{name: obis, value: value}
-				result = append(result, newReading)
-			} else {
-				log.Infof("Skipped value %f for obis %s because implausible or 0", value, obis)
-			}
-		} else {
-			logDebug("Skipping message because of undecoded size")
+		if entry.value.kind != SML_TYPE_UNSIGNED && entry.value.kind != SML_TYPE_INTEGER {
+			logDebug("Skipping obis entry %s without numeric value", obis)
+			continue
+		}
+
+		raw := entry.value.int64()
+		logDebug("Decoded raw value %d with scaler %d", raw, entry.scaler)
+		value := float64(raw) / float64(options.Factor)
+		logDebug("Decoded value %f", value)
+		readingTime := telegramTime
+		if timeType, seconds, ok := entry.valTime.smlTime(); ok {
+			readingTime = clock.timestamp(timeType, seconds, telegramTime)
+		}
+		newReading := meterReading{name: obis, obis: code, value: value, unit: entry.unit, scaler: entry.scaler, raw: raw, time: readingTime}
+		if entry.status.kind == SML_TYPE_UNSIGNED && len(entry.status.value) > 0 {
+			newReading.status = uint64(entry.status.int64())
+			newReading.hasStatus = true
 		}
+		result = append(result, newReading)
 	}
 	return result
 }
@@ -210,3 +512,52 @@ func extractMeterReadings(smlListResponse []byte) []meterReading {
 02                                        # Anzahl der Füll-Bytes
 29 10                                     # Prüfsumme
 */
+
+// scanMeterReadings finds the energy registers of channel 0 by searching for their
+// OBIS code and unit in the raw list response. It is used for telegrams which
+// parseListResponse rejects, so a single malformed entry does not lose the readings.
+func scanMeterReadings(smlListResponse []byte, telegramTime time.Time) []meterReading {
+	result := make([]meterReading, 0, 5)
+	// split on list start and obis prefix
+	dataSplice := bytes.Split(smlListResponse, mustDecodeStringToHex(SML_OBIS_PREFIX))
+	for _, data := range dataSplice[1:] {
+		logDebug("Decoding obis chunk\n%s", formatHexBytes(data, 32))
+		if len(data) < 12 {
+			log.Printf("Data chunk too small, %d<12", len(data))
+			continue
+		}
+		code := obisCode{1, 0, data[0], data[1], data[2], data[3]}
+		obis := code.shortName()
+		logDebug("Decoded obis %s", obis)
+		// split on unit definition (Wh)
+		dataSplice2 := bytes.SplitN(data, mustDecodeStringToHex(SML_UNIT_WATT_HOUR_ELEMENT), 2)
+		if len(dataSplice2) < 2 {
+			logDebug("Skipping obis entry %s without expected unit", obis)
+			continue
+		}
+		data = dataSplice2[1]
+		scaler, n, err := parseSmlElement(data)
+		if err != nil || scaler.kind != SML_TYPE_INTEGER {
+			logDebug("Skipping obis entry %s without scaler", obis)
+			continue
+		}
+		value, _, err := parseSmlElement(data[n:])
+		if err != nil || (value.kind != SML_TYPE_UNSIGNED && value.kind != SML_TYPE_INTEGER) {
+			logDebug("Skipping obis entry %s without numeric value", obis)
+			continue
+		}
+
+		raw := value.int64()
+		logDebug("Decoded raw value %d with scaler %d", raw, scaler.int64())
+		result = append(result, meterReading{
+			name:   obis,
+			obis:   code,
+			value:  float64(raw) / float64(options.Factor),
+			unit:   SML_UNIT_WATT_HOUR,
+			scaler: int8(scaler.int64()),
+			raw:    raw,
+			time:   telegramTime,
+		})
+	}
+	return result
+}
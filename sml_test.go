@@ -2,11 +2,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"io"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -31,14 +34,15 @@ func (f *fakePort) Close() error                { return nil }
 
 func TestMain(m *testing.M) {
 	options.Factor = 1
-	options.MaxValue = 10000000
+	options.MaxValue = 1000000000
 	options.Debug = true
 	log.SetLevel(log.DebugLevel)
 
 	os.Exit(m.Run())
 }
 
-func prepareTestdata(filename string, t *testing.T) *fakePort {
+// readTestdata decodes a hex dump of a captured telegram
+func readTestdata(filename string, t *testing.T) []byte {
 	file, err := os.Open(filename)
 	if err != nil {
 		t.Fatalf("could not open testdata: %v", err)
@@ -57,6 +61,11 @@ func prepareTestdata(filename string, t *testing.T) *fakePort {
 	if err != nil {
 		t.Fatalf("could not decode hex: %v", err)
 	}
+	return data
+}
+
+func prepareTestdata(filename string, t *testing.T) *fakePort {
+	data := readTestdata(filename, t)
 
 	// Simuliere Port-Lesevorgänge in 32-Byte-Blöcken
 	var chunks [][]byte
@@ -83,6 +92,19 @@ func TestNormalRead(t *testing.T) {
 	}
 }
 
+func TestReadGarbage(t *testing.T) {
+	garbage := make([][]byte, 100)
+	for i := range garbage {
+		garbage[i] = bytes.Repeat([]byte{0x55}, 250)
+	}
+	if _, err := readMessage(&fakePort{data: garbage}); !errors.Is(err, errFraming) {
+		t.Errorf("readMessage of garbage returned %v instead of a framing error", err)
+	}
+	if _, err := readMessage(&fakePort{}); errors.Is(err, errFraming) || !errors.Is(err, io.EOF) {
+		t.Errorf("readMessage of a closed port returned %v instead of the error of the port", err)
+	}
+}
+
 func TestExtractListResponse(t *testing.T) {
 
 	port := prepareTestdata("testdata/smlfile-1", t)
@@ -110,8 +132,135 @@ func TestExtractMeterReadings(t *testing.T) {
 	if err != nil {
 		t.Fatalf("extractListResponse failed: %v", err)
 	}
-	readings := extractMeterReadings(smlListResponse)
-	if len(readings) != 4 {
+	response, err := parseListResponse(smlListResponse)
+	if err != nil {
+		t.Fatalf("parseListResponse failed: %v", err)
+	}
+	readings := extractMeterReadings(response, time.Now(), &sensorClock{})
+	if len(readings) != 6 {
 		t.Error("extractMeterReadings returned wrong amount of results")
 	}
+	if !readings[0].hasStatus || readings[0].status != 0x00010182 {
+		t.Errorf("extractMeterReadings returned status %x for %s", readings[0].status, readings[0].name)
+	}
+}
+
+func TestDecodeStatusWord(t *testing.T) {
+	tests := []struct {
+		name   string
+		status uint64
+		flags  map[string]bool
+	}{
+		// ISKRA MT681 of testdata/smlfile-1, which does not report voltages
+		{"iskra", 0x00010182, map[string]bool{"load_detected": true, "energy_direction_export": false, "fatal_error": false}},
+		// EMH eHZ with voltage on all phases
+		{"emh", 0x001c0104, map[string]bool{"load_detected": true, "energy_direction_export": false, "backstop_active": false, "fatal_error": false, "voltage_l1_present": true, "voltage_l2_present": true, "voltage_l3_present": true}},
+		// EMH eHZ exporting, with L2 lost
+		{"emh export", 0x00140904, map[string]bool{"load_detected": true, "energy_direction_export": true, "backstop_active": false, "voltage_l1_present": true, "voltage_l2_present": false, "voltage_l3_present": true}},
+	}
+	for _, test := range tests {
+		flags := decodeStatusWord(test.status)
+		for flag, expected := range test.flags {
+			if set, ok := flags[flag]; !ok || set != expected {
+				t.Errorf("%s: flag %s of 0x%08x is %t (known %t) instead of %t", test.name, flag, test.status, set, ok, expected)
+			}
+		}
+		if _, ok := test.flags["voltage_l1_present"]; !ok {
+			if _, ok := flags["voltage_l1_present"]; ok {
+				t.Errorf("%s: decodeStatusWord returned voltage flags for 0x%08x without voltage bits", test.name, test.status)
+			}
+		}
+	}
+}
+
+func TestExtractMeterIdentity(t *testing.T) {
+
+	port := prepareTestdata("testdata/smlfile-1", t)
+	msg, err := readMessage(port)
+	if err != nil {
+		t.Fatalf("readMessage failed: %v", err)
+	}
+	smlListResponse, err := extractListResponse(msg)
+	if err != nil {
+		t.Fatalf("extractListResponse failed: %v", err)
+	}
+	response, err := parseListResponse(smlListResponse)
+	if err != nil {
+		t.Fatalf("parseListResponse failed: %v", err)
+	}
+	if len(response.entries) != 9 {
+		t.Errorf("parseListResponse returned %d entries instead of 9", len(response.entries))
+	}
+	identity := extractMeterIdentity(response)
+	if identity.manufacturer != "ISK" {
+		t.Errorf("extractMeterIdentity returned manufacturer %q instead of ISK", identity.manufacturer)
+	}
+	if identity.serverID != "090149534b00050cd2eb" {
+		t.Errorf("extractMeterIdentity returned server ID %q", identity.serverID)
+	}
+	timeType, seconds, ok := response.actSensorTime.smlTime()
+	if !ok || timeType != SML_TIME_SEC_INDEX || seconds != 0x07488f63 {
+		t.Errorf("smlTime returned %d, %d, %t instead of secIndex %d", timeType, seconds, ok, 0x07488f63)
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	options.VerifyChecksum = true
+	defer func() { options.VerifyChecksum = false }()
+
+	port := prepareTestdata("testdata/smlfile-crc", t)
+	msg, err := readMessage(port)
+	if err != nil {
+		t.Fatalf("readMessage failed: %v", err)
+	}
+
+	msg[20] ^= 0xff
+	if err := verifyChecksum(msg); !errors.Is(err, errChecksum) {
+		t.Errorf("verifyChecksum of a corrupted message returned %v", err)
+	}
+}
+
+func TestScanMeterReadings(t *testing.T) {
+	for _, filename := range []string{"testdata/smlfile-1", "testdata/smlfile-crc"} {
+		port := prepareTestdata(filename, t)
+		msg, err := readMessage(port)
+		if err != nil {
+			t.Fatalf("%s: readMessage failed: %v", filename, err)
+		}
+		smlListResponse, err := extractListResponse(msg)
+		if err != nil {
+			t.Fatalf("%s: extractListResponse failed: %v", filename, err)
+		}
+		response, err := parseListResponse(smlListResponse)
+		if err != nil {
+			t.Fatalf("%s: parseListResponse failed: %v", filename, err)
+		}
+
+		// scanning finds the same energy registers as decoding the structure
+		expected := make([]meterReading, 0)
+		for _, reading := range extractMeterReadings(response, time.Time{}, &sensorClock{}) {
+			if reading.unit == SML_UNIT_WATT_HOUR {
+				expected = append(expected, reading)
+			}
+		}
+		scanned := scanMeterReadings(smlListResponse, time.Time{})
+		if len(scanned) == 0 || len(scanned) != len(expected) {
+			t.Fatalf("%s: scanMeterReadings returned %d readings instead of %d", filename, len(scanned), len(expected))
+		}
+		for i, reading := range scanned {
+			want := expected[i]
+			if reading.name != want.name || reading.obis != want.obis || reading.raw != want.raw || reading.scaler != want.scaler || reading.value != want.value {
+				t.Errorf("%s: scanMeterReadings returned %+v instead of %+v", filename, reading, want)
+			}
+		}
+
+		// a telegram cut off within the list still yields the registers before the cut
+		truncated := smlListResponse[:len(smlListResponse)*2/3]
+		if _, err := parseListResponse(truncated); err == nil {
+			t.Errorf("%s: parseListResponse accepted a truncated list response", filename)
+		}
+		if readings := scanMeterReadings(truncated, time.Time{}); len(readings) == 0 || readings[0].name != "1.8.0" {
+			t.Errorf("%s: scanMeterReadings of a truncated list response returned %+v", filename, readings)
+		}
+	}
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	gaugeSpoolDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "powermeter",
+		Name:      "queue_depth",
+		Help:      "Number of items waiting to be sent",
+	},
+		[]string{
+			//name of the queue, like remote_write
+			"queue",
+		})
+	counterSpoolDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "powermeter",
+		Name:      "queue_dropped_total",
+		Help:      "Number of items dropped because the queue was full or the item was rejected",
+	},
+		[]string{
+			//name of the queue, like remote_write
+			"queue",
+		})
+)
+
+// spoolQueue is a bounded FIFO of encoded items waiting to be sent. If a
+// directory is given, every item is also kept as a file there, so nothing
+// is lost if the exporter is restarted while the receiver is unreachable.
+// The files are prefixed with the name of the queue, so queues can share a directory.
+type spoolQueue struct {
+	mutex   sync.Mutex
+	name    string
+	dir     string
+	limit   int
+	items   []spoolItem
+	nextSeq uint64
+	// number of items removed after being sent or rejected, to tell whether a flush got anywhere
+	removed uint64
+}
+
+type spoolItem struct {
+	seq  uint64
+	data []byte
+}
+
+const spoolFileSuffix = ".item"
+
+func newSpoolQueue(name string, dir string, limit int) (*spoolQueue, error) {
+	q := &spoolQueue{name: name, dir: dir, limit: limit}
+	if len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, err
+		}
+		if err := q.load(); err != nil {
+			return nil, err
+		}
+	}
+	gaugeSpoolDepth.WithLabelValues(name).Set(float64(len(q.items)))
+	return q, nil
+}
+
+// load restores the items left over by a previous run, in their original order
+func (q *spoolQueue) load() error {
+	prefix := q.name + "-"
+	files, err := filepath.Glob(filepath.Join(q.dir, prefix+"*"+spoolFileSuffix))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), prefix), spoolFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Warnf("Failed to read queued item %s: %v", file, err)
+			continue
+		}
+		q.items = append(q.items, spoolItem{seq: seq, data: data})
+	}
+	sort.Slice(q.items, func(i, j int) bool { return q.items[i].seq < q.items[j].seq })
+	if len(q.items) > 0 {
+		q.nextSeq = q.items[len(q.items)-1].seq + 1
+		logDebug("Restored %d queued items for %s", len(q.items), q.name)
+	}
+	for len(q.items) > q.limit {
+		q.dropOldest()
+	}
+	return nil
+}
+
+func (q *spoolQueue) filename(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%s-%020d%s", q.name, seq, spoolFileSuffix))
+}
+
+// push appends an item, dropping the oldest one if the queue is full
+func (q *spoolQueue) push(data []byte) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.items) >= q.limit && len(q.items) > 0 {
+		q.dropOldest()
+	}
+	item := spoolItem{seq: q.nextSeq, data: data}
+	q.nextSeq++
+	if len(q.dir) > 0 {
+		if err := os.WriteFile(q.filename(item.seq), data, 0o640); err != nil {
+			log.Warnf("Failed to persist queued item for %s: %v", q.name, err)
+		}
+	}
+	q.items = append(q.items, item)
+	gaugeSpoolDepth.WithLabelValues(q.name).Set(float64(len(q.items)))
+}
+
+// peek returns up to n of the oldest items without removing them, and the
+// sequence number of the last one to remove them with once they are sent
+func (q *spoolQueue) peek(n int) ([][]byte, uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if n > len(q.items) {
+		n = len(q.items)
+	}
+	result := make([][]byte, n)
+	var last uint64
+	for i := 0; i < n; i++ {
+		result[i] = q.items[i].data
+		last = q.items[i].seq
+	}
+	return result, last
+}
+
+// remove deletes the peeked items up to the sequence number last after they
+// have been sent. Items dropped by push in the meantime are skipped, newer ones kept.
+func (q *spoolQueue) remove(last uint64) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	n := 0
+	for n < len(q.items) && q.items[n].seq <= last {
+		q.deleteFile(q.items[n].seq)
+		n++
+	}
+	q.items = q.items[n:]
+	q.removed += uint64(n)
+	gaugeSpoolDepth.WithLabelValues(q.name).Set(float64(len(q.items)))
+	return n
+}
+
+// drop removes the peeked items up to the sequence number last as they can never be sent
+func (q *spoolQueue) drop(last uint64) {
+	n := q.remove(last)
+	counterSpoolDropped.WithLabelValues(q.name).Add(float64(n))
+}
+
+// removals returns the number of items removed so far by remove and drop
+func (q *spoolQueue) removals() uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.removed
+}
+
+func (q *spoolQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
+
+func (q *spoolQueue) dropOldest() {
+	q.deleteFile(q.items[0].seq)
+	q.items = q.items[1:]
+	counterSpoolDropped.WithLabelValues(q.name).Inc()
+}
+
+func (q *spoolQueue) deleteFile(seq uint64) {
+	if len(q.dir) == 0 {
+		return
+	}
+	if err := os.Remove(q.filename(seq)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove queued item for %s: %v", q.name, err)
+	}
+}
+
+// classifyWriteResponse decides by the response of a write endpoint what happens
+// to the sent batch. It returns an error if the batch is to be kept for a retry,
+// because the endpoint answered with a server error or 429, or refused the
+// credentials, which can be fixed. It returns drop if the endpoint rejected the
+// batch otherwise, as sending it again will not help. If neither, the batch was
+// written and can be removed.
+func classifyWriteResponse(response *http.Response, body []byte) (drop bool, err error) {
+	switch {
+	case response.StatusCode/100 == 2:
+		return false, nil
+	case response.StatusCode/100 == 5 || response.StatusCode == http.StatusTooManyRequests:
+		return false, fmt.Errorf("Server returned %s: %s", response.Status, bytes.TrimSpace(body))
+	case response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden:
+		return false, fmt.Errorf("Server refused the credentials with %s: %s", response.Status, bytes.TrimSpace(body))
+	default:
+		return true, nil
+	}
+}
+
+// flushRemaining calls flush until the queue is empty, a flush fails or the
+// deadline has passed. Items left over are lost, unless the queue has a directory.
+func flushRemaining(q *spoolQueue, flush func() error, deadline time.Time) {
+	for q.len() > 0 && time.Now().Before(deadline) {
+		if progress, err := flushProgress(q, flush); err != nil {
+			log.Warnf("Sending to %s failed on shutdown, %d items left: %v", q.name, q.len(), err)
+			return
+		} else if !progress {
+			return
+		}
+	}
+}
+
+// flushPeriodically calls flush every interval until the queue is empty or a
+// flush fails, in which case the remaining items are retried in the next interval.
+func flushPeriodically(q *spoolQueue, interval time.Duration, flush func() error) {
+	for {
+		time.Sleep(interval)
+		for q.len() > 0 {
+			if progress, err := flushProgress(q, flush); err != nil {
+				log.Warnf("Sending to %s failed, %d items queued: %v", q.name, q.len(), err)
+				break
+			} else if !progress {
+				break
+			}
+		}
+	}
+}
+
+// flushProgress calls flush and reports whether it removed any items, so callers
+// flushing until the queue is empty do not spin on a flush which sends nothing
+func flushProgress(q *spoolQueue, flush func() error) (bool, error) {
+	removed := q.removals()
+	if err := flush(); err != nil {
+		return false, err
+	}
+	return q.removals() != removed, nil
+}
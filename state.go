@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// persistedValue is the last accepted value of a reading
+type persistedValue struct {
+	Value float64   `json:"value"`
+	Time  time.Time `json:"time"`
+}
+
+// persistedBaseline is the reference point for deriving power from an energy register
+type persistedBaseline struct {
+	Value    float64   `json:"value"`
+	Time     time.Time `json:"time"`
+	LastSeen time.Time `json:"last_seen"`
+	Aligned  bool      `json:"aligned"`
+	Step     float64   `json:"step,omitempty"`
+	Power    float64   `json:"power,omitempty"`
+}
+
+// persistedState is the content of the state file, values by meter name and obis id
+type persistedState struct {
+	Meters       map[string]map[string]persistedValue    `json:"meters"`
+	DerivedPower map[string]map[string]persistedBaseline `json:"derived_power,omitempty"`
+}
+
+// stateChanged is set when readings have been accepted since the state file was written
+var stateChanged atomic.Bool
+
+// loadState restores the last accepted values of the meter from the state file.
+// A missing file is not an error, as it is expected on the first start.
+func loadState(filename string) error {
+	content, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		logDebug("State file %s does not exist yet", filename)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := persistedState{}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return err
+	}
+	plausibility.mutex.Lock()
+	for name, value := range state.Meters[options.MeterName] {
+		logDebug("Restored %s with value %f from %s", name, value.Value, value.Time)
+		plausibility.last[name] = &plausibilityState{value: value.Value, time: value.Time}
+	}
+	plausibility.mutex.Unlock()
+
+	energyBaselinesLock.Lock()
+	for name, baseline := range state.DerivedPower[options.MeterName] {
+		logDebug("Restored power derivation of %s from %f at %s", name, baseline.Value, baseline.Time)
+		energyBaselines[name] = &energyBaseline{value: baseline.Value, time: baseline.Time, lastSeen: baseline.LastSeen, aligned: baseline.Aligned, step: baseline.Step, power: baseline.Power}
+	}
+	energyBaselinesLock.Unlock()
+	return nil
+}
+
+// saveStatePeriodically writes the state file every interval if readings have
+// been accepted since, to spare SD cards from writing it after every read.
+func saveStatePeriodically(filename string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		saveStateIfChanged(filename)
+	}
+}
+
+// saveStateIfChanged writes the state file if readings have been accepted since it was last written
+func saveStateIfChanged(filename string) {
+	if !stateChanged.Swap(false) {
+		return
+	}
+	if err := saveState(filename); err != nil {
+		stateChanged.Store(true)
+		log.Warnf("Failed to save state: %v", err)
+	}
+}
+
+// saveState writes the last accepted values to the state file. The file is
+// replaced atomically, so a crash never leaves a partially written state.
+func saveState(filename string) error {
+	state := persistedState{}
+
+	// keep the values of other meters sharing the file
+	if content, err := os.ReadFile(filename); err == nil {
+		_ = json.Unmarshal(content, &state)
+	}
+	if state.Meters == nil {
+		state.Meters = make(map[string]map[string]persistedValue)
+	}
+	if state.DerivedPower == nil {
+		state.DerivedPower = make(map[string]map[string]persistedBaseline)
+	}
+
+	plausibility.mutex.Lock()
+	values := make(map[string]persistedValue, len(plausibility.last))
+	for name, last := range plausibility.last {
+		values[name] = persistedValue{Value: last.value, Time: last.time}
+	}
+	plausibility.mutex.Unlock()
+	state.Meters[options.MeterName] = values
+
+	energyBaselinesLock.Lock()
+	baselines := make(map[string]persistedBaseline, len(energyBaselines))
+	for name, baseline := range energyBaselines {
+		baselines[name] = persistedBaseline{Value: baseline.value, Time: baseline.time, LastSeen: baseline.lastSeen, Aligned: baseline.aligned, Step: baseline.step, Power: baseline.power}
+	}
+	energyBaselinesLock.Unlock()
+	if len(baselines) > 0 {
+		state.DerivedPower[options.MeterName] = baselines
+	}
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
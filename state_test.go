@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateRoundtrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+	options.MeterName = "test"
+	defer func() { options.MeterName = "" }()
+
+	readingTime := time.Unix(1700000000, 0).UTC()
+	plausibility = newPlausibilityEngine()
+	plausibility.accept(meterReading{name: "1.8.0", raw: 1234, time: readingTime})
+	energyBaselines = map[string]*energyBaseline{"1.8.0": {value: 1230, time: readingTime, lastSeen: readingTime, aligned: true, step: 1, power: 360}}
+	if err := saveState(filename); err != nil {
+		t.Fatalf("saveState failed: %v", err)
+	}
+
+	plausibility = newPlausibilityEngine()
+	energyBaselines = make(map[string]*energyBaseline)
+	if err := loadState(filename); err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	last, ok := plausibility.last["1.8.0"]
+	if !ok || last.value != 1234 || !last.time.Equal(readingTime) {
+		t.Errorf("loadState restored %v instead of 1234 at %s", last, readingTime)
+	}
+	baseline, ok := energyBaselines["1.8.0"]
+	if !ok || baseline.value != 1230 || !baseline.time.Equal(readingTime) || !baseline.aligned || baseline.step != 1 || baseline.power != 360 {
+		t.Errorf("loadState restored power derivation %+v", baseline)
+	}
+
+	if err := loadState(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("loadState failed for a missing file: %v", err)
+	}
+}
+
+func TestSaveStateIfChanged(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+	plausibility = newPlausibilityEngine()
+
+	stateChanged.Store(false)
+	saveStateIfChanged(filename)
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("saveStateIfChanged wrote the state file without changes")
+	}
+
+	stateChanged.Store(true)
+	saveStateIfChanged(filename)
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("saveStateIfChanged did not write the state file: %v", err)
+	}
+	if stateChanged.Load() {
+		t.Errorf("saveStateIfChanged did not reset the change")
+	}
+}
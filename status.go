@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var gaugeStatusFlag = newStatusFlagGauge(promauto.With(prometheus.DefaultRegisterer))
+
+func newStatusFlagGauge(factory promauto.Factory) *prometheus.GaugeVec {
+	return factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "powermeter",
+		Name:      "status_flag",
+		Help:      "Flags decoded from the status word of a reading, 1 if set",
+	},
+		[]string{
+			//manual name of the meter, to distinguish between multiple sensors
+			"meter_name",
+			//obis id of the reading carrying the status word
+			"meter_id",
+			//name of the flag
+			"flag",
+		})
+}
+
+// statusFlag is a single bit of the status word
+type statusFlag struct {
+	bit  uint
+	name string
+}
+
+// statusFlags are the bits of the status word as defined for basic meters in
+// the FNN Lastenheft EDL. The bits below 8 are not decoded.
+var statusFlags = []statusFlag{
+	{bit: 8, name: "load_detected"},
+	{bit: 9, name: "magnetic_field_detected"},
+	{bit: 10, name: "manipulation_detected"},
+	{bit: 11, name: "energy_direction_export"},
+	{bit: 12, name: "energy_direction_export_l1"},
+	{bit: 13, name: "energy_direction_export_l2"},
+	{bit: 14, name: "energy_direction_export_l3"},
+	{bit: 15, name: "rotating_field_counterclockwise"},
+	{bit: 16, name: "backstop_active"},
+	{bit: 17, name: "fatal_error"},
+	{bit: 18, name: "voltage_l1_present"},
+	{bit: 19, name: "voltage_l2_present"},
+	{bit: 20, name: "voltage_l3_present"},
+}
+
+// statusVoltageBits are the bits telling whether voltage is present on L1 to L3
+const statusVoltageBits = 1<<18 | 1<<19 | 1<<20
+
+// decodeStatusWord returns the state of all known flags of the status word.
+// A meter sending telegrams is powered by at least one phase, so if none of the
+// voltage bits is set, the meter does not report them (e.g. the ISKRA MT681) and
+// the voltage flags are left out instead of claiming all phases to be dead.
+func decodeStatusWord(status uint64) map[string]bool {
+	result := make(map[string]bool, len(statusFlags))
+	for _, flag := range statusFlags {
+		if status&statusVoltageBits == 0 && statusVoltageBits&(1<<flag.bit) != 0 {
+			continue
+		}
+		result[flag.name] = status&(1<<flag.bit) != 0
+	}
+	return result
+}
+
+func recordStatusFlags(gauge *prometheus.GaugeVec, expiry *seriesExpiry, meterName string, reading meterReading) {
+	for flag, set := range decodeStatusWord(reading.status) {
+		value := 0.0
+		if set {
+			value = 1
+		}
+		gauge.WithLabelValues(meterName, reading.name, flag).Set(value)
+		expiry.touch(gauge, meterName, reading.name, flag)
+	}
+}
+
+// statusAttributes returns the status word and its flags as MQTT attributes.
+func statusAttributes(reading meterReading) map[string]interface{} {
+	attributes := map[string]interface{}{
+		"status": fmt.Sprintf("0x%08x", reading.status),
+	}
+	for flag, set := range decodeStatusWord(reading.status) {
+		attributes[flag] = set
+	}
+	return attributes
+}